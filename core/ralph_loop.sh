@@ -5,13 +5,33 @@
 # This script repeatedly calls an AI agent to complete tasks from a task file
 # until all tasks are done, max iterations reached, or build failures occur.
 #
-# Usage: .ralph/ralph_loop.sh [agent]
+# Usage: .ralph/ralph_loop.sh [options] [agent]
 #   agent: Agent name (default: from config or 'cursor')
 #
+# Options:
+#   --dry-run         Print the prompt the agent would receive, then exit
+#   --profile NAME    Layer .ralph/config.NAME.sh over config.sh
+#   --model NAME      Use this model for the run instead of DEFAULT_MODEL
+#   --validate-config Check the config for errors, then exit
+#   --file PATH       With --validate-config, check PATH instead of config.sh
+#   --doctor          Diagnose setup problems (agent, git, scripts, config), then exit
+#   --agent-test      Send a one-off prompt (--prompt TEXT or stdin) to the agent, then exit
+#   --approve         Ask to run, skip or abort before each task (reads stdin when piped)
+#   --only ID         Only run this task (repeat or comma-separate for several)
+#   --log-prompts     Record every prompt and response in logs/prompts_<run id>.jsonl
+#   --history ID      List every iteration of a task from past run reports, then exit
+#   --grep PATTERN    Search past iteration logs (narrow with --run ID, --task ID,
+#                     show surrounding lines with --context N), then exit
+#   --force           Start even if another run seems to be active in this project
+#
 # Examples:
 #   .ralph/ralph_loop.sh           # Uses default agent from config
 #   .ralph/ralph_loop.sh cursor    # Uses Cursor
 #   .ralph/ralph_loop.sh auggie    # Uses Augment
+#   .ralph/ralph_loop.sh --dry-run # Preview the prompt without calling the agent
+#   .ralph/ralph_loop.sh --profile ci  # Uses config.sh + config.ci.sh
+#   .ralph/ralph_loop.sh --model sonnet-4.5  # One-off model override
+#   .ralph/ralph_loop.sh --agent-test --prompt "Say hi, then print NEXT"
 #
 # Project Setup:
 #   This script lives in your project's .ralph/ directory alongside:
@@ -43,27 +63,106 @@ NC='\033[0m' # No Color
 MAX_ITERATIONS=50
 PAUSE_SECONDS=5
 MAX_CONSECUTIVE_FAILURES=3
+STUCK_TIMEOUT_MINUTES=0  # Kill the agent if its log is silent this long (0 = disabled)
+AGENT_TIMEOUT_MINUTES=0  # Kill the agent after this long, output or not (0 = no limit)
+CURSOR_TIMEOUT_MINUTES=""        # Per-agent overrides of AGENT_TIMEOUT_MINUTES (empty = use it)
+AUGGIE_TIMEOUT_MINUTES=""
+CUSTOM_AGENT_TIMEOUT_MINUTES=""
+MAX_RUN_MINUTES=0        # Stop starting new iterations after this long (0 = unlimited)
+STREAM_AGENT_OUTPUT=false  # Print agent output as it arrives instead of the progress display
+RUN_REPORT_ENABLED=true    # Write a markdown summary of each run to logs/report_<run id>.md
 DEFAULT_AGENT="cursor"
+CUSTOM_AGENT_ENV=()  # Extra "NAME=value" variables for run_agent_custom; ${VAR} is expanded at run time
+CUSTOM_AGENT_VERSION_COMMAND=""  # e.g. "my-agent --version"; its first x.y[.z] is the agent version
+CUSTOM_AGENT_MIN_VERSION=""      # Refuse to run a custom agent older than this (needs the command above)
+ENV_FILE=""  # KEY=VALUE file (e.g. ".env", relative to the project) loaded before the agent runs
 DEFAULT_MODEL=""  # Empty means use agent's default; can be set in config.sh
+MODEL_FALLBACKS=""  # Models to switch to, in order, instead of stopping on consecutive failures
 REQUIRE_BRANCH=true
 ALLOWED_BRANCHES=""  # Empty means any non-main branch
 AUTO_COMMIT=true
 COMMIT_PREFIX="feat"
 COMMIT_SCOPE=""
+COMMIT_EACH_ITERATION=false  # Also commit work from iterations that don't finish a task
+COMMIT_STAGE_MODE="all"  # What commits include: "all", "tracked" (no new files) or "task" (files the task changed)
+COMMIT_AUTHOR_NAME=""   # Author/committer for Ralph's commits (empty = the repo's git config)
+COMMIT_AUTHOR_EMAIL=""
+COMMIT_CO_AUTHOR=""     # "Name <email>" for a Co-authored-by trailer; ${AGENT_TYPE} and ${SELECTED_MODEL} are expanded
+SQUASH_WIP_COMMITS=true      # Fold those WIP commits into the task's completion commit
+ROLLBACK_ON_FAILURE=false    # Undo a task's changes when the loop stops because of it
+
+# Status markers the agent prints, for agents that word them differently.
+# NEXT, DONE, FIXED and CLEAN must end a line, BLOCKED must start one and
+# ERROR can appear anywhere. Each status needs at least one phrase.
+STATUS_KEYWORDS_NEXT=("NEXT")
+STATUS_KEYWORDS_DONE=("DONE")
+STATUS_KEYWORDS_FIXED=("FIXED")
+STATUS_KEYWORDS_CLEAN=("CLEAN")
+STATUS_KEYWORDS_ERROR=("ERROR:")
+STATUS_KEYWORDS_BLOCKED=("BLOCKED:")
 
 # Build verification settings
 BUILD_GATE_ENABLED=true
-BUILD_FIX_ATTEMPTS=1
+BUILD_FIX_ATTEMPTS=1  # Fix attempts before the run stops (0 = stop at once); a task's [fix-attempts: N] wins
 
 # Test verification settings
 TEST_GATE_ENABLED=true
-TEST_FIX_ATTEMPTS=1
+TEST_FIX_ATTEMPTS=1   # Also used for verify.sh
+TEST_FLAKY_RETRIES=0  # Rerun failing tests up to this many times before treating them as failed
+TEST_CHANGED_ONLY=false  # Pass test.sh the files changed by the task in RALPH_CHANGED_FILES
+
+# How much of a failing build/test/verify script's output to show, and in the run report
+BUILD_OUTPUT_LINES=20
+TEST_OUTPUT_LINES=30    # Also used for verify.sh
+REPORT_OUTPUT_LINES=20  # Final agent output per iteration in the run report
+OUTPUT_TRUNCATION="tail"  # Which lines to keep: "tail", "head", or "both" (half of each)
+
+# Custom verification settings (only used if .ralph/verify.sh exists)
+# "additional" runs it after the build and test gates, "replace" instead of them
+VERIFY_MODE="additional"
+# Run build.sh, test.sh and verify.sh at the same time after each task
+# (only for projects where they don't interfere with each other)
+VERIFY_PARALLEL=false
 
 # Test run mode settings
 # When enabled, runs first N tasks then pauses for user verification
 TEST_RUN_ENABLED=true
 TEST_RUN_TASKS=2
 
+# Ask to run, skip or abort before every task (also --approve)
+REQUIRE_APPROVAL=false
+
+# Hook settings
+# What to do when .ralph/hooks/pre_loop.sh fails: "abort" or "continue"
+PRE_LOOP_HOOK_ON_FAILURE="abort"
+HOOK_TIMEOUT_SECONDS=0  # Kill hooks that run longer than this (0 = no limit)
+INCLUDE_FAILED_HOOK_OUTPUT=false  # Pass pre_task hook output to the agent even if it failed
+
+# Notifications when a run ends; failing to notify never stops anything
+# {status} (success, failed or interrupted), {completed} and {failed} are filled in
+NOTIFY_COMMAND=""     # e.g. 'curl -s -d "Ralph {status}: {completed} done" ntfy.sh/my-topic'
+NOTIFY_DESKTOP=false  # Desktop notification via osascript (macOS) or notify-send (Linux)
+
+# Master log format: "text" (what the terminal shows) or "json" (one object per line)
+LOG_FORMAT="text"
+
+# Record every prompt and response in logs/prompts_<run id>.jsonl (also --log-prompts)
+LOG_PROMPTS=false
+LOG_PROMPTS_RESPONSE_LINES=200  # Lines of each response to keep (OUTPUT_TRUNCATION applies)
+
+# Log redaction settings
+# Secrets are replaced with [REDACTED] in everything written to .ralph/logs/
+REDACT_SECRETS=true  # Mask values of environment variables ending in _TOKEN, _KEY or _SECRET
+REDACT_PATTERNS=()   # Extra extended regexes to mask, e.g. ('sk-[A-Za-z0-9]{20,}')
+
+# Documentation context
+# Files matching these globs (relative to the project) are added to every prompt
+DOCS_PATTERNS=(".ralph/docs/*")
+DOCS_MAX_BYTES=20000  # Stop adding docs once this much has been included (0 = no docs)
+
+# Commits made earlier in the run are summarized (git log --stat) in each prompt
+PREVIOUS_CHANGES_MAX_LINES=80  # 0 = leave them out
+
 # Review mode settings
 # When enabled, runs a review agent after every N tasks to check quality
 REVIEW_MODE_ENABLED=false
@@ -73,8 +172,183 @@ REVIEW_EVERY_N_TASKS=3
 # ARGUMENT PARSING
 #==============================================================================
 
-# Optional: agent override as first argument
-AGENT_OVERRIDE="${1:-}"
+AGENT_OVERRIDE=""
+MODEL_OVERRIDE=""
+DRY_RUN=false
+PROFILE="${RALPH_PROFILE:-}"
+VALIDATE_CONFIG=false
+VALIDATE_FILE=""
+RUN_DOCTOR=false
+RUN_CLEAN=false
+HISTORY_TASK=""
+GREP_PATTERN=""
+GREP_RUN=""
+GREP_TASK=""
+GREP_CONTEXT=0
+AGENT_TEST=false
+AGENT_TEST_PROMPT=""
+APPROVE_OVERRIDE=false
+LOG_PROMPTS_OVERRIDE=false
+WATCH_CONFIG=false
+ENV_FILE_OVERRIDE=""
+ASSUME_YES=false
+FORCE_LOCK=false
+TAG_FILTER=""          # --tags: only run tasks with one of these tags
+EXCLUDE_TAG_FILTER=""  # --exclude-tags: skip tasks with any of these tags
+ONLY_TASKS=""          # --only: only run these task IDs (comma-separated, repeatable)
+
+while [ $# -gt 0 ]; do
+    case "$1" in
+        --dry-run)
+            DRY_RUN=true
+            ;;
+        --profile)
+            if [ -z "$2" ]; then
+                echo -e "${RED}ERROR: --profile requires a name${NC}"
+                exit 1
+            fi
+            PROFILE="$2"
+            shift
+            ;;
+        --model)
+            if [ -z "$2" ]; then
+                echo -e "${RED}ERROR: --model requires a name${NC}"
+                exit 1
+            fi
+            MODEL_OVERRIDE="$2"
+            shift
+            ;;
+        --validate-config)
+            VALIDATE_CONFIG=true
+            ;;
+        --doctor)
+            RUN_DOCTOR=true
+            ;;
+        --clean)
+            RUN_CLEAN=true
+            ;;
+        --history)
+            if [ -z "$2" ]; then
+                echo -e "${RED}ERROR: --history requires a task ID${NC}"
+                exit 1
+            fi
+            HISTORY_TASK="$2"
+            shift
+            ;;
+        --grep)
+            if [ -z "$2" ]; then
+                echo -e "${RED}ERROR: --grep requires a pattern${NC}"
+                exit 1
+            fi
+            GREP_PATTERN="$2"
+            shift
+            ;;
+        --run)
+            if [ -z "$2" ]; then
+                echo -e "${RED}ERROR: --run requires a run ID${NC}"
+                exit 1
+            fi
+            GREP_RUN="$2"
+            shift
+            ;;
+        --task)
+            if [ -z "$2" ]; then
+                echo -e "${RED}ERROR: --task requires a task ID${NC}"
+                exit 1
+            fi
+            GREP_TASK="$2"
+            shift
+            ;;
+        --context)
+            if ! [[ "$2" =~ ^[0-9]+$ ]]; then
+                echo -e "${RED}ERROR: --context requires a number of lines${NC}"
+                exit 1
+            fi
+            GREP_CONTEXT="$2"
+            shift
+            ;;
+        --agent-test)
+            AGENT_TEST=true
+            ;;
+        --approve)
+            APPROVE_OVERRIDE=true
+            ;;
+        --log-prompts)
+            LOG_PROMPTS_OVERRIDE=true
+            ;;
+        --prompt)
+            if [ -z "$2" ]; then
+                echo -e "${RED}ERROR: --prompt requires text${NC}"
+                exit 1
+            fi
+            AGENT_TEST_PROMPT="$2"
+            shift
+            ;;
+        --watch-config)
+            WATCH_CONFIG=true
+            ;;
+        --env-file)
+            if [ -z "$2" ]; then
+                echo -e "${RED}ERROR: --env-file requires a path${NC}"
+                exit 1
+            fi
+            ENV_FILE_OVERRIDE="$2"
+            shift
+            ;;
+        --yes|-y)
+            ASSUME_YES=true
+            ;;
+        --force)
+            FORCE_LOCK=true
+            ;;
+        --tags)
+            if [ -z "$2" ]; then
+                echo -e "${RED}ERROR: --tags requires a comma-separated list${NC}"
+                exit 1
+            fi
+            TAG_FILTER="$2"
+            shift
+            ;;
+        --exclude-tags)
+            if [ -z "$2" ]; then
+                echo -e "${RED}ERROR: --exclude-tags requires a comma-separated list${NC}"
+                exit 1
+            fi
+            EXCLUDE_TAG_FILTER="$2"
+            shift
+            ;;
+        --only)
+            if [ -z "$2" ]; then
+                echo -e "${RED}ERROR: --only requires a task ID${NC}"
+                exit 1
+            fi
+            ONLY_TASKS="${ONLY_TASKS:+$ONLY_TASKS,}$2"
+            shift
+            ;;
+        --file)
+            if [ -z "$2" ]; then
+                echo -e "${RED}ERROR: --file requires a path${NC}"
+                exit 1
+            fi
+            VALIDATE_FILE="$2"
+            shift
+            ;;
+        -*)
+            echo -e "${RED}ERROR: Unknown option '$1'${NC}"
+            exit 1
+            ;;
+        *)
+            # Optional: agent override as positional argument
+            AGENT_OVERRIDE="$1"
+            ;;
+    esac
+    shift
+done
+
+if [ -n "$VALIDATE_FILE" ] && [ "$VALIDATE_CONFIG" != "true" ]; then
+    echo -e "${RED}ERROR: --file only works with --validate-config${NC}"
+    exit 1
+fi
 
 #==============================================================================
 # LOAD PROJECT CONFIGURATION
@@ -85,991 +359,3891 @@ RALPH_CONFIG_DIR="$RALPH_DIR"
 CONFIG_FILE="$RALPH_CONFIG_DIR/config.sh"
 TASK_FILE="$RALPH_CONFIG_DIR/TASKS.md"
 
+if [ -n "$VALIDATE_FILE" ]; then
+    CONFIG_FILE="$VALIDATE_FILE"
+fi
+
 if [ ! -f "$CONFIG_FILE" ]; then
     echo -e "${RED}ERROR: Config file not found: $CONFIG_FILE${NC}"
     exit 1
 fi
 
-# Source the project config (this can override defaults above)
-source "$CONFIG_FILE"
+if ! bash -n "$CONFIG_FILE" 2>/dev/null; then
+    echo -e "${RED}ERROR: Config file has syntax errors: $CONFIG_FILE${NC}"
+    bash -n "$CONFIG_FILE"
+    exit 1
+fi
 
-# Apply agent override if provided
-if [ -n "$AGENT_OVERRIDE" ]; then
-    AGENT_TYPE="$AGENT_OVERRIDE"
+# Per-user defaults shared by every project: ~/.config/ralph/config.sh.
+# Loaded before the project config so project values win; skipped when absent.
+USER_CONFIG_FILE="${XDG_CONFIG_HOME:-$HOME/.config}/ralph/config.sh"
+if [ -f "$USER_CONFIG_FILE" ]; then
+    if ! bash -n "$USER_CONFIG_FILE" 2>/dev/null; then
+        echo -e "${RED}ERROR: User config has syntax errors: $USER_CONFIG_FILE${NC}"
+        bash -n "$USER_CONFIG_FILE"
+        exit 1
+    fi
+    source "$USER_CONFIG_FILE"
+    # CONFIG_EXTENDS is resolved relative to .ralph/, so only projects set it
+    unset CONFIG_EXTENDS
 else
-    AGENT_TYPE="${AGENT_TYPE:-$DEFAULT_AGENT}"
+    USER_CONFIG_FILE=""
 fi
 
-#==============================================================================
-# VALIDATE CONFIGURATION
-#==============================================================================
+# Source the project config (this can override defaults above)
+source "$CONFIG_FILE"
 
-# Task file is required
-if [ ! -f "$TASK_FILE" ]; then
-    echo -e "${RED}ERROR: Task file not found: $TASK_FILE${NC}"
-    exit 1
-fi
+# Physical path of an existing file, following symlinks to it and its directories
+resolve_file_path() {
+    local file="$1"
+    local target links=0
+
+    while [ -L "$file" ] && [ $links -lt 20 ]; do
+        target=$(readlink "$file")
+        case "$target" in
+            /*) file="$target" ;;
+            *) file="$(dirname "$file")/$target" ;;
+        esac
+        links=$((links + 1))
+    done
+    echo "$(cd "$(dirname "$file")" && pwd -P)/$(basename "$file")"
+}
 
-# Validate agent is available
-validate_agent() {
-    case "$AGENT_TYPE" in
-        cursor)
-            if ! command -v agent &> /dev/null; then
-                echo -e "${RED}ERROR: Cursor CLI not found!${NC}"
-                echo ""
-                echo "The 'agent' command is required to use Cursor as the AI agent."
-                echo ""
-                echo "To install Cursor CLI:"
-                echo "  1. Open Cursor"
-                echo "  2. Press Cmd+Shift+P (or Ctrl+Shift+P)"
-                echo "  3. Type 'Install cursor command' and select it"
-                echo ""
-                echo "Or switch to a different agent in .ralph/config.sh"
-                exit 1
-            fi
-            ;;
-        auggie)
-            if ! command -v auggie &> /dev/null; then
-                echo -e "${RED}ERROR: Augment CLI not found!${NC}"
-                echo ""
-                echo "The 'auggie' command is required to use Augment as the AI agent."
-                echo ""
-                echo "Visit https://augmentcode.com for installation instructions."
-                echo ""
-                echo "Or switch to a different agent in .ralph/config.sh"
-                exit 1
-            fi
-            ;;
-        custom)
-            if ! type run_agent_custom &> /dev/null; then
-                echo -e "${RED}ERROR: Custom agent selected but run_agent_custom() not defined!${NC}"
-                echo ""
-                echo "Define run_agent_custom() in .ralph/config.sh"
-                echo ""
-                echo "Example:"
-                echo "  run_agent_custom() {"
-                echo "      local prompt=\"\$1\""
-                echo "      local log_file=\"\$2\""
-                echo "      # Your custom agent command here"
-                echo "  }"
+# Directory CONFIG_EXTENDS files must be inside: the parent of the project's
+# repository, or the repository itself when it sits at the filesystem root
+# (e.g. /app), where the parent would allow any file
+get_extends_root() {
+    local top_level=$(git -C "$1" rev-parse --show-toplevel 2>/dev/null || echo "$1")
+    top_level=$(cd "$top_level" && pwd -P)
+    local parent=$(dirname "$top_level")
+
+    if [ "$parent" = "/" ]; then
+        echo "$top_level"
+    else
+        echo "$parent"
+    fi
+}
+
+# Shared base config: CONFIG_EXTENDS="../shared/ralph.sh" (relative to .ralph/).
+# The base is sourced first, then config.sh again so project values win.
+# Only one level is supported. The resolved file must be inside the parent
+# directory of the project's repository (e.g. a sibling checkout), or the
+# repository itself if it's at the filesystem root; anything else, including
+# absolute paths, needs CONFIG_EXTENDS_ALLOW_ABSOLUTE=true.
+if [ -n "$CONFIG_EXTENDS" ]; then
+    case "$CONFIG_EXTENDS" in
+        /*)
+            if [ "$CONFIG_EXTENDS_ALLOW_ABSOLUTE" != "true" ]; then
+                echo -e "${RED}ERROR: CONFIG_EXTENDS must be relative to .ralph/: $CONFIG_EXTENDS${NC}"
+                echo "Set CONFIG_EXTENDS_ALLOW_ABSOLUTE=true to allow absolute paths."
                 exit 1
             fi
+            EXTENDS_FILE="$CONFIG_EXTENDS"
             ;;
         *)
-            echo -e "${RED}ERROR: Unknown agent type '$AGENT_TYPE'${NC}"
-            echo ""
-            echo "Valid options: cursor, auggie, custom"
-            echo "Set AGENT_TYPE in .ralph/config.sh"
-            exit 1
+            EXTENDS_FILE="$RALPH_CONFIG_DIR/$CONFIG_EXTENDS"
             ;;
     esac
-}
 
-validate_agent
-
-# Validate build and test scripts exist
-validate_scripts() {
-    local build_script="$RALPH_CONFIG_DIR/build.sh"
-    local test_script="$RALPH_CONFIG_DIR/test.sh"
-    local has_errors=false
+    if [ ! -f "$EXTENDS_FILE" ]; then
+        echo -e "${RED}ERROR: Extended config not found: $EXTENDS_FILE${NC}"
+        exit 1
+    fi
 
-    # Check build.sh exists
-    if [ ! -f "$build_script" ]; then
-        echo -e "${RED}ERROR: Build script not found: $build_script${NC}"
-        has_errors=true
-    elif [ ! -x "$build_script" ]; then
-        echo -e "${YELLOW}Warning: Build script is not executable: $build_script${NC}"
-        echo "Making it executable..."
-        chmod +x "$build_script"
+    if [ "$CONFIG_EXTENDS_ALLOW_ABSOLUTE" != "true" ]; then
+        EXTENDS_FILE=$(resolve_file_path "$EXTENDS_FILE")
+        EXTENDS_ROOT=$(get_extends_root "$PROJECT_DIR")
+        case "$EXTENDS_FILE" in
+            "${EXTENDS_ROOT%/}"/*) ;;
+            *)
+                echo -e "${RED}ERROR: CONFIG_EXTENDS points outside ${EXTENDS_ROOT}: $EXTENDS_FILE${NC}"
+                echo "Set CONFIG_EXTENDS_ALLOW_ABSOLUTE=true to allow config files anywhere."
+                exit 1
+                ;;
+        esac
     fi
 
-    # Check test.sh exists
-    if [ ! -f "$test_script" ]; then
-        echo -e "${RED}ERROR: Test script not found: $test_script${NC}"
-        has_errors=true
-    elif [ ! -x "$test_script" ]; then
-        echo -e "${YELLOW}Warning: Test script is not executable: $test_script${NC}"
-        echo "Making it executable..."
-        chmod +x "$test_script"
+    unset CONFIG_EXTENDS
+    source "$EXTENDS_FILE"
+    if [ -n "$CONFIG_EXTENDS" ]; then
+        echo -e "${RED}ERROR: $EXTENDS_FILE sets CONFIG_EXTENDS itself${NC}"
+        echo "Only one level of CONFIG_EXTENDS is supported."
+        exit 1
     fi
+    source "$CONFIG_FILE"
+fi
 
-    if [ "$has_errors" = true ]; then
+# Layer the selected profile over the base config (e.g. config.ci.sh)
+if [ -n "$PROFILE" ]; then
+    PROFILE_FILE="$RALPH_CONFIG_DIR/config.${PROFILE}.sh"
+    if [ ! -f "$PROFILE_FILE" ]; then
+        echo -e "${RED}ERROR: Unknown profile '$PROFILE'${NC}"
         echo ""
-        echo "Run the Ralph Loop installer to create missing scripts:"
-        echo "  curl -fsSL https://raw.githubusercontent.com/ralphloopai/ralph-loop/main/install.sh | bash"
+        echo "Create $PROFILE_FILE with the settings to override."
+        exit 1
+    fi
+    source "$PROFILE_FILE"
+fi
+
+# Apply agent override if provided
+if [ -n "$AGENT_OVERRIDE" ]; then
+    AGENT_TYPE="$AGENT_OVERRIDE"
+else
+    AGENT_TYPE="${AGENT_TYPE:-$DEFAULT_AGENT}"
+fi
+
+# Apply model override if provided (skips the model prompt)
+if [ -n "$MODEL_OVERRIDE" ]; then
+    DEFAULT_MODEL="$MODEL_OVERRIDE"
+fi
+
+if [ -n "$ENV_FILE_OVERRIDE" ]; then
+    ENV_FILE="$ENV_FILE_OVERRIDE"
+fi
+
+if [ "$APPROVE_OVERRIDE" = "true" ]; then
+    REQUIRE_APPROVAL=true
+fi
+
+if [ "$LOG_PROMPTS_OVERRIDE" = "true" ]; then
+    LOG_PROMPTS=true
+fi
+
+# Export KEY=VALUE pairs from ENV_FILE so agents and hooks see them.
+# Variables already set in the environment win; quotes around values are
+# stripped, but nothing is expanded.
+load_env_file() {
+    local env_file="$1"
+    case "$env_file" in
+        /*) ;;
+        *) env_file="$PROJECT_DIR/$env_file" ;;
+    esac
+
+    if [ ! -f "$env_file" ]; then
+        echo -e "${RED}ERROR: Env file not found: $env_file${NC}"
         exit 1
     fi
+
+    local line key value
+    while IFS= read -r line || [ -n "$line" ]; do
+        line="${line%$'\r'}"
+        if [[ "$line" =~ ^[[:space:]]*(export[[:space:]]+)?([A-Za-z_][A-Za-z0-9_]*)=(.*)$ ]]; then
+            key="${BASH_REMATCH[2]}"
+            value="${BASH_REMATCH[3]}"
+            if [[ "$value" =~ ^\"(.*)\"$ ]] || [[ "$value" =~ ^\'(.*)\'$ ]]; then
+                value="${BASH_REMATCH[1]}"
+            fi
+            if [ -z "${!key+set}" ]; then
+                export "$key=$value"
+            fi
+        fi
+    done < "$env_file"
 }
 
-validate_scripts
+if [ -n "$ENV_FILE" ]; then
+    load_env_file "$ENV_FILE"
+fi
 
 #==============================================================================
-# MODEL SELECTION
+# VALIDATE CONFIGURATION
 #==============================================================================
 
-# Get available models for the current agent
-get_available_models() {
+# Check config values, printing one line per problem.
+# Returns 1 if any value is invalid.
+validate_config_values() {
+    local integer_settings=(
+        MAX_ITERATIONS PAUSE_SECONDS MAX_CONSECUTIVE_FAILURES STUCK_TIMEOUT_MINUTES AGENT_TIMEOUT_MINUTES MAX_RUN_MINUTES
+        HOOK_TIMEOUT_SECONDS DOCS_MAX_BYTES PREVIOUS_CHANGES_MAX_LINES LOG_PROMPTS_RESPONSE_LINES
+        BUILD_OUTPUT_LINES TEST_OUTPUT_LINES REPORT_OUTPUT_LINES
+        TEST_RUN_TASKS BUILD_FIX_ATTEMPTS TEST_FIX_ATTEMPTS TEST_FLAKY_RETRIES REVIEW_EVERY_N_TASKS
+    )
+    local boolean_settings=(
+        REQUIRE_BRANCH AUTO_COMMIT BUILD_GATE_ENABLED TEST_GATE_ENABLED
+        TEST_RUN_ENABLED REVIEW_MODE_ENABLED INCLUDE_FAILED_HOOK_OUTPUT STREAM_AGENT_OUTPUT
+        RUN_REPORT_ENABLED COMMIT_EACH_ITERATION SQUASH_WIP_COMMITS ROLLBACK_ON_FAILURE
+        TEST_CHANGED_ONLY REDACT_SECRETS REQUIRE_APPROVAL VERIFY_PARALLEL LOG_PROMPTS NOTIFY_DESKTOP
+    )
+    local errors=0
+    local name
+
     case "$AGENT_TYPE" in
-        cursor)
-            # Parse cursor agent models, extracting just the model IDs
-            agent --list-models 2>/dev/null | grep -E "^[a-z]" | awk '{print $1}' | grep -v "^Tip:" | grep -v "^Available"
+        cursor|auggie|custom) ;;
+        *)
+            echo "AGENT_TYPE: must be cursor, auggie, or custom (got '$AGENT_TYPE')"
+            errors=$((errors + 1))
             ;;
-        auggie)
-            # Auggie models list (may not be available)
-            auggie models list 2>/dev/null | grep -E "^[a-z]" | awk '{print $1}' || echo "default"
+    esac
+
+    case "$PRE_LOOP_HOOK_ON_FAILURE" in
+        abort|continue) ;;
+        *)
+            echo "PRE_LOOP_HOOK_ON_FAILURE: must be abort or continue (got '$PRE_LOOP_HOOK_ON_FAILURE')"
+            errors=$((errors + 1))
             ;;
+    esac
+
+    local entry
+    for entry in "${CUSTOM_AGENT_ENV[@]}"; do
+        if ! [[ "$entry" =~ ^[A-Za-z_][A-Za-z0-9_]*= ]]; then
+            echo "CUSTOM_AGENT_ENV: entries must look like NAME=value (got '$entry')"
+            errors=$((errors + 1))
+        fi
+    done
+
+    case "$LOG_FORMAT" in
+        text|json) ;;
         *)
-            echo ""
+            echo "LOG_FORMAT: must be text or json (got '$LOG_FORMAT')"
+            errors=$((errors + 1))
             ;;
     esac
-}
 
-# Get the default/current model for the agent
-get_default_model() {
-    case "$AGENT_TYPE" in
-        cursor)
-            # Look for (current) or (default) marker
-            agent --list-models 2>/dev/null | grep -E "\(current\)|\(default\)" | head -1 | awk '{print $1}'
+    case "$OUTPUT_TRUNCATION" in
+        tail|head|both) ;;
+        *)
+            echo "OUTPUT_TRUNCATION: must be tail, head, or both (got '$OUTPUT_TRUNCATION')"
+            errors=$((errors + 1))
             ;;
-        auggie)
-            echo "default"
+    esac
+
+    case "$COMMIT_STAGE_MODE" in
+        all|tracked|task) ;;
+        *)
+            echo "COMMIT_STAGE_MODE: must be all, tracked or task (got '$COMMIT_STAGE_MODE')"
+            errors=$((errors + 1))
             ;;
+    esac
+
+    case "$VERIFY_MODE" in
+        additional|replace) ;;
         *)
-            echo ""
+            echo "VERIFY_MODE: must be additional or replace (got '$VERIFY_MODE')"
+            errors=$((errors + 1))
             ;;
     esac
-}
 
-# Prompt user to select a model
-select_model() {
-    echo -e "${CYAN}Fetching available models for $AGENT_TYPE...${NC}"
+    local status keywords
+    for status in NEXT DONE FIXED CLEAN ERROR BLOCKED; do
+        eval 'keywords="${STATUS_KEYWORDS_'"$status"'[*]}"'
+        if [ -z "${keywords//[[:space:]]/}" ]; then
+            echo "STATUS_KEYWORDS_$status: must list at least one keyword"
+            errors=$((errors + 1))
+        fi
+    done
 
-    local models_list=$(get_available_models)
-    local default_model=$(get_default_model)
+    for name in "${integer_settings[@]}"; do
+        if ! [[ "${!name}" =~ ^[0-9]+$ ]]; then
+            echo "$name: must be a non-negative integer (got '${!name}')"
+            errors=$((errors + 1))
+        fi
+    done
 
-    if [ -z "$models_list" ] || [ "$models_list" = "default" ]; then
-        echo -e "Using default model for $AGENT_TYPE"
-        SELECTED_MODEL=""
-        return
-    fi
+    for name in CURSOR_TIMEOUT_MINUTES AUGGIE_TIMEOUT_MINUTES CUSTOM_AGENT_TIMEOUT_MINUTES; do
+        if [ -n "${!name}" ] && ! [[ "${!name}" =~ ^[0-9]+$ ]]; then
+            echo "$name: must be empty or a non-negative integer (got '${!name}')"
+            errors=$((errors + 1))
+        fi
+    done
 
-    local model_count=$(echo "$models_list" | wc -l | tr -d ' ')
+    for name in "${boolean_settings[@]}"; do
+        case "${!name}" in
+            true|false) ;;
+            *)
+                echo "$name: must be true or false (got '${!name}')"
+                errors=$((errors + 1))
+                ;;
+        esac
+    done
 
-    echo ""
-    echo -e "${GREEN}Available models ($model_count):${NC}"
-    echo ""
+    [ $errors -eq 0 ]
+}
 
-    local i=1
-    local default_index=1
-    while IFS= read -r model; do
-        if [ "$model" = "$default_model" ]; then
-            echo -e "  $i) $model ${YELLOW}(current)${NC}"
-            default_index=$i
-        else
-            echo "  $i) $model"
+# Check the custom agent against CUSTOM_AGENT_MIN_VERSION.
+# Sets CUSTOM_AGENT_VERSION; on failure sets CUSTOM_AGENT_VERSION_ERROR and returns 1.
+CUSTOM_AGENT_VERSION=""
+CUSTOM_AGENT_VERSION_ERROR=""
+check_custom_agent_version() {
+    if [ -z "$CUSTOM_AGENT_VERSION_COMMAND" ]; then
+        return 0
+    fi
+
+    local output
+    if ! output=$(cd "$PROJECT_DIR" && bash -c "$CUSTOM_AGENT_VERSION_COMMAND" 2>&1); then
+        CUSTOM_AGENT_VERSION_ERROR="'$CUSTOM_AGENT_VERSION_COMMAND' failed"
+        if [ -n "$output" ]; then
+            CUSTOM_AGENT_VERSION_ERROR+=": $(echo "$output" | head -1)"
         fi
-        ((i++))
-    done <<< "$models_list"
+        return 1
+    fi
+
+    CUSTOM_AGENT_VERSION=$(echo "$output" | grep -oE '[0-9]+\.[0-9]+(\.[0-9]+)?' | head -1)
+    if [ -z "$CUSTOM_AGENT_VERSION" ]; then
+        CUSTOM_AGENT_VERSION_ERROR="No version number in the output of '$CUSTOM_AGENT_VERSION_COMMAND'"
+        return 1
+    fi
+
+    if [ -n "$CUSTOM_AGENT_MIN_VERSION" ]; then
+        local lowest=$(printf '%s\n%s\n' "$CUSTOM_AGENT_MIN_VERSION" "$CUSTOM_AGENT_VERSION" | sort -V | head -1)
+        if [ "$lowest" != "$CUSTOM_AGENT_MIN_VERSION" ]; then
+            CUSTOM_AGENT_VERSION_ERROR="Custom agent version $CUSTOM_AGENT_VERSION is older than the required $CUSTOM_AGENT_MIN_VERSION"
+            return 1
+        fi
+    fi
+    return 0
+}
+
+# Diagnostics for --doctor: prints a pass/warn/fail checklist with fixes.
+# Returns 1 if any hard requirement fails.
+run_doctor() {
+    local failures=0
+
+    doctor_pass() {
+        echo -e "  ${GREEN}✓${NC} $1"
+    }
+
+    doctor_warn() {
+        echo -e "  ${YELLOW}⚠${NC} $1"
+        if [ -n "$2" ]; then
+            echo "      $2"
+        fi
+    }
+
+    doctor_fail() {
+        echo -e "  ${RED}✗${NC} $1"
+        if [ -n "$2" ]; then
+            echo "      $2"
+        fi
+        failures=$((failures + 1))
+    }
 
     echo ""
-    echo -en "${CYAN}Select model [$default_index]: ${NC}"
-    read -r model_choice </dev/tty
+    echo -e "${BLUE}Ralph Loop Doctor${NC}"
+    echo ""
 
-    if [ -z "$model_choice" ]; then
-        model_choice=$default_index
+    # Git
+    if ! command -v git &> /dev/null; then
+        doctor_fail "git is not installed" "Install git and try again"
+    elif ! git -C "$PROJECT_DIR" rev-parse --git-dir &> /dev/null; then
+        doctor_fail "Project is not a git repository" "Run: git init"
+    else
+        local branch=$(git -C "$PROJECT_DIR" rev-parse --abbrev-ref HEAD 2>/dev/null)
+        if [ "$REQUIRE_BRANCH" = "true" ] && { [ "$branch" = "main" ] || [ "$branch" = "master" ]; }; then
+            doctor_fail "On protected branch '$branch'" "Create a feature branch: git checkout -b feature/my-feature"
+        else
+            doctor_pass "git repository on branch '$branch'"
+        fi
     fi
 
-    SELECTED_MODEL=$(echo "$models_list" | sed -n "${model_choice}p")
+    # Config
+    local config_errors
+    if config_errors=$(validate_config_values); then
+        doctor_pass "Config is valid: $CONFIG_FILE"
+    else
+        doctor_fail "Config has errors: $CONFIG_FILE" "Run: .ralph/ralph_loop.sh --validate-config"
+        echo "$config_errors" | sed 's/^/      /'
+    fi
 
-    if [ -z "$SELECTED_MODEL" ]; then
-        SELECTED_MODEL="$default_model"
+    # Agent
+    case "$AGENT_TYPE" in
+        cursor)
+            if command -v agent &> /dev/null; then
+                doctor_pass "Cursor CLI (agent) is installed"
+            else
+                doctor_fail "Cursor CLI (agent) not found" "In Cursor: Cmd+Shift+P > 'Install cursor command'"
+            fi
+            ;;
+        auggie)
+            if command -v auggie &> /dev/null; then
+                doctor_pass "Augment CLI (auggie) is installed"
+            else
+                doctor_fail "Augment CLI (auggie) not found" "See https://augmentcode.com for installation instructions"
+            fi
+            ;;
+        custom)
+            if type run_agent_custom &> /dev/null; then
+                doctor_pass "Custom agent run_agent_custom() is defined"
+            else
+                doctor_fail "run_agent_custom() is not defined" "Define it in .ralph/config.sh"
+            fi
+            if ! check_custom_agent_version; then
+                doctor_fail "$CUSTOM_AGENT_VERSION_ERROR" "Update the agent or change CUSTOM_AGENT_MIN_VERSION"
+            elif [ -n "$CUSTOM_AGENT_VERSION" ]; then
+                doctor_pass "Custom agent version ${CUSTOM_AGENT_VERSION}"
+            fi
+            ;;
+    esac
+
+    # Build and test scripts
+    local script
+    for script in build.sh test.sh; do
+        local script_path="$RALPH_CONFIG_DIR/$script"
+        if [ ! -f "$script_path" ]; then
+            doctor_fail "$script not found" "Run the Ralph Loop installer to create it"
+        elif grep -q "# PLACEHOLDER:" "$script_path" 2>/dev/null; then
+            doctor_warn "$script is still a placeholder" "Edit .ralph/$script or run the AI setup assistant"
+        elif [ ! -x "$script_path" ]; then
+            doctor_warn "$script is not executable" "Run: chmod +x .ralph/$script"
+        else
+            doctor_pass "$script is configured"
+        fi
+    done
+
+    # Prompt files
+    local prompt_file
+    for prompt_file in platform_prompt.txt project_prompt.txt; do
+        if grep -q "<!-- PLACEHOLDER:" "$RALPH_CONFIG_DIR/$prompt_file" 2>/dev/null; then
+            doctor_warn "$prompt_file is still a placeholder" "It will be skipped when building the prompt"
+        fi
+    done
+
+    # Tasks
+    local remaining=0
+    if [ -f "$TASK_FILE" ]; then
+        remaining=$(grep -c "^\- \[ \]" "$TASK_FILE" 2>/dev/null) || true
+    fi
+    if [ ! -f "$TASK_FILE" ]; then
+        doctor_fail "Task file not found: $TASK_FILE" "Create .ralph/TASKS.md with '- [ ] TASK-001: ...' items"
+    elif [ "${remaining:-0}" -eq 0 ]; then
+        doctor_warn "No unchecked tasks in TASKS.md" "Add '- [ ] TASK-ID: ...' items to run"
+    else
+        doctor_pass "$remaining task(s) remaining in TASKS.md"
+    fi
+    if [ -f "$TASK_FILE" ]; then
+        local duplicate_ids=$(grep -oE '^- \[[ x]\] [A-Za-z][A-Za-z0-9_]*-[0-9]+:' "$TASK_FILE" | sed -E 's/^- \[[ x]\] //; s/:$//' | sort | uniq -d | tr '\n' ' ')
+        if [ -n "$duplicate_ids" ]; then
+            doctor_fail "Duplicate task IDs in TASKS.md: ${duplicate_ids% }" "Give each task a unique ID"
+        fi
+    fi
+
+    # Logs
+    local log_dir="$RALPH_CONFIG_DIR/logs"
+    if mkdir -p "$log_dir" 2>/dev/null && [ -w "$log_dir" ]; then
+        doctor_pass "Log directory is writable"
+    else
+        doctor_fail "Cannot write to $log_dir" "Check the directory's permissions"
     fi
 
-    echo -e "Selected: ${GREEN}$SELECTED_MODEL${NC}"
     echo ""
+    if [ $failures -gt 0 ]; then
+        echo -e "${RED}✗ $failures problem(s) must be fixed before running${NC}"
+        return 1
+    fi
+    echo -e "${GREEN}✓ Ready to run${NC}"
+    return 0
 }
 
-# Select model if not already set
-if [ -z "$DEFAULT_MODEL" ]; then
-    select_model
-else
-    SELECTED_MODEL="$DEFAULT_MODEL"
-    echo -e "Using configured model: ${GREEN}$SELECTED_MODEL${NC}"
+if [ "$VALIDATE_CONFIG" = "true" ]; then
+    if config_errors=$(validate_config_values); then
+        echo -e "${GREEN}✓ Config is valid: $CONFIG_FILE${NC}"
+        exit 0
+    fi
+    echo -e "${RED}✗ Config has errors: $CONFIG_FILE${NC}"
+    echo "$config_errors" | sed 's/^/  /'
+    exit 1
 fi
 
-#==============================================================================
-# SETUP LOGGING
-#==============================================================================
+if [ "$RUN_DOCTOR" = "true" ]; then
+    run_doctor
+    exit $?
+fi
 
-LOG_DIR="$RALPH_CONFIG_DIR/logs"
-mkdir -p "$LOG_DIR"
+# Remove generated run artifacts (logs and reports). Config, tasks,
+# prompts and scripts are never touched.
+run_clean() {
+    local logs_dir="$RALPH_CONFIG_DIR/logs"
+    local files=()
+    if [ -d "$logs_dir" ]; then
+        while IFS= read -r file; do
+            files+=("$file")
+        done < <(find "$logs_dir" -mindepth 1 -maxdepth 1 | sort)
+    fi
 
-RUN_ID=$(date +"%Y%m%d_%H%M%S")
-MASTER_LOG="$LOG_DIR/ralph_run_${RUN_ID}.log"
-touch "$MASTER_LOG"
+    if [ ${#files[@]} -eq 0 ]; then
+        echo -e "${GREEN}✓ Nothing to clean${NC}"
+        return 0
+    fi
 
-log() {
-    echo -e "$1" | tee -a "$MASTER_LOG"
+    echo -e "${BLUE}Files to delete:${NC}"
+    local file
+    for file in "${files[@]}"; do
+        echo "  ${file#$PROJECT_DIR/}"
+    done
+    echo ""
+
+    if [ "$ASSUME_YES" != "true" ]; then
+        echo -en "${BOLD}Delete ${#files[@]} item(s)? [y/N]: ${NC}" >&2
+        local response
+        read -r response </dev/tty
+        response=$(echo "$response" | tr '[:upper:]' '[:lower:]')
+        if [ "$response" != "y" ] && [ "$response" != "yes" ]; then
+            echo "Nothing deleted."
+            return 1
+        fi
+    fi
+
+    rm -rf "${files[@]}"
+    echo -e "${GREEN}✓ Deleted ${#files[@]} item(s) from ${logs_dir#$PROJECT_DIR/}${NC}"
 }
 
-log_only() {
-    echo -e "$1" >> "$MASTER_LOG"
+if [ "$RUN_CLEAN" = "true" ]; then
+    run_clean
+    exit $?
+fi
+
+# Every iteration of one task (or of all tasks, without an ID) in past runs,
+# read back from the run reports in logs/ (oldest first). Tab-separated:
+# run id, iteration, status, duration, model, log, task id.
+get_task_history() {
+    local task_id="$1"
+    local report
+    for report in "$RALPH_CONFIG_DIR"/logs/report_*.md; do
+        [ -f "$report" ] || continue
+        local run_id="${report##*/report_}"
+        run_id="${run_id%.md}"
+        awk -v task="$task_id" -v run="$run_id" '
+            function flush() {
+                if (inside) printf "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", run, f["Iteration"], f["Status"], f["Duration"], f["Model"], f["Log"], id
+                inside = 0
+                split("", f)
+            }
+            /^## / { flush() }
+            /^### / {
+                flush()
+                id = substr($0, 5); sub(/:.*/, "", id)
+                inside = (task == "" || id == task)
+                next
+            }
+            inside && /^- \*\*[^*]+:\*\* / {
+                key = $0; sub(/^- \*\*/, "", key); sub(/:\*\*.*/, "", key)
+                value = $0; sub(/^- \*\*[^*]+:\*\* /, "", value); gsub(/`/, "", value)
+                f[key] = value
+            }
+            END { flush() }
+        ' "$report"
+    done
 }
 
-#==============================================================================
-# BRANCH VERIFICATION
-#==============================================================================
+run_history() {
+    local task_id="$1"
+    local history=$(get_task_history "$task_id")
 
-verify_branch() {
-    if [ "$REQUIRE_BRANCH" != "true" ]; then
-        return 0
-    fi
-    
-    cd "$PROJECT_DIR"
-    local current_branch=$(git rev-parse --abbrev-ref HEAD 2>/dev/null || echo "")
-    
-    if [ -z "$current_branch" ]; then
-        log "${RED}ERROR: Not a git repository: $PROJECT_DIR${NC}"
-        exit 1
+    if [ -z "$history" ]; then
+        echo -e "${YELLOW}No iterations of ${task_id} found in ${RALPH_CONFIG_DIR#$PROJECT_DIR/}/logs${NC}"
+        return 1
     fi
-    
-    # Check if on main/master (not allowed)
-    if [ "$current_branch" = "main" ] || [ "$current_branch" = "master" ]; then
-        log "${RED}ERROR: Cannot run on '$current_branch' branch${NC}"
-        log "${YELLOW}Create a feature branch first: git checkout -b feature/my-feature${NC}"
-        exit 1
+
+    local task_line=$(grep -E "^- \[[ xX]\] ${task_id}:" "$TASK_FILE" 2>/dev/null | head -1)
+    echo -e "${BLUE}History of ${task_id}${NC}"
+    if [ -n "$task_line" ]; then
+        echo "  ${task_line#- }"
     fi
-    
-    # Check allowed branches if specified
-    if [ -n "$ALLOWED_BRANCHES" ]; then
-        if ! echo "$ALLOWED_BRANCHES" | grep -qw "$current_branch"; then
-            log "${RED}ERROR: Branch '$current_branch' not in allowed list${NC}"
-            log "${YELLOW}Allowed branches: $ALLOWED_BRANCHES${NC}"
-            exit 1
+    echo ""
+
+    local run_id iteration status duration model log_file runs=0 last_run=""
+    while IFS=$'\t' read -r run_id iteration status duration model log_file _; do
+        if [ "$run_id" != "$last_run" ]; then
+            [ -n "$last_run" ] && echo ""
+            echo "Run ${run_id}"
+            last_run="$run_id"
+            runs=$((runs + 1))
         fi
-    fi
-    
-    log "${GREEN}✓ On branch: $current_branch${NC}"
-    cd - > /dev/null
+        echo "  Iteration ${iteration}: ${status} (${duration}, model: ${model})"
+        echo "    Log: ${log_file#$PROJECT_DIR/}"
+    done <<< "$history"
+
+    echo ""
+    echo "$(echo "$history" | wc -l | tr -d ' ') iteration(s) across ${runs} run(s)"
 }
 
-#==============================================================================
-# BUILD PROMPT (3-Level System)
-#==============================================================================
-#
-# Prompts are combined from 3 levels:
-#   1. Global (base_prompt.txt) - Ralph Loop workflow instructions
-#   2. Platform (.ralph/platform_prompt.txt) - Platform guidelines
-#   3. Project (.ralph/project_prompt.txt) - Project-specific instructions
-#
-# Placeholder files (containing "<!-- PLACEHOLDER:") are skipped.
-# Each level can be edited independently without affecting the others.
-#
+if [ -n "$HISTORY_TASK" ]; then
+    run_history "$HISTORY_TASK"
+    exit $?
+fi
 
-# Check if a file contains placeholder content (not yet configured)
-is_placeholder_file() {
-    local file="$1"
-    if [ ! -f "$file" ]; then
+# Search the agent output of past iterations (the logs the run reports
+# point to), optionally only for one run (GREP_RUN) or task (GREP_TASK)
+run_log_grep() {
+    local pattern="$1"
+
+    # grep exits 2 for an invalid pattern, 1 for no match
+    local check=0
+    echo "" | grep -qE -- "$pattern" 2>/dev/null || check=$?
+    if [ "$check" -eq 2 ]; then
+        echo -e "${RED}ERROR: Invalid pattern: ${pattern}${NC}"
         return 1
     fi
-    grep -q "<!-- PLACEHOLDER:" "$file" 2>/dev/null
-}
 
-build_prompt() {
-    local base_prompt_file="$RALPH_DIR/base_prompt.txt"
-    local platform_prompt_file="$RALPH_CONFIG_DIR/platform_prompt.txt"
-    local project_prompt_file="$RALPH_CONFIG_DIR/project_prompt.txt"
+    local context_args=()
+    if [ "$GREP_CONTEXT" -gt 0 ]; then
+        context_args=(-C "$GREP_CONTEXT")
+    fi
 
-    # Level 1: Global/Ralph Loop instructions
-    if [ -f "$base_prompt_file" ]; then
-        echo "# Level 1: Ralph Loop Instructions"
-        echo ""
-        cat "$base_prompt_file"
-        echo ""
-        echo "---"
+    local run_id iteration status duration model log_file task_id found searched=0 matched=0
+    while IFS=$'\t' read -r run_id iteration status duration model log_file task_id; do
+        if [ -z "$run_id" ] || [ ! -f "$log_file" ]; then
+            continue
+        fi
+        if [ -n "$GREP_RUN" ] && [ "$run_id" != "$GREP_RUN" ]; then
+            continue
+        fi
+        searched=$((searched + 1))
+
+        if ! found=$(grep -nE "${context_args[@]}" -- "$pattern" "$log_file"); then
+            continue
+        fi
+        matched=$((matched + 1))
+        echo -e "${BLUE}${task_id}${NC} - run ${run_id}, iteration ${iteration} (${status})"
+        echo "  ${log_file#$PROJECT_DIR/}"
+        echo "$found" | sed 's/^/    /'
         echo ""
+    done <<< "$(get_task_history "$GREP_TASK")"
+
+    if [ "$matched" -eq 0 ]; then
+        echo -e "${YELLOW}No matches in ${searched} iteration log(s)${NC}"
+        return 1
     fi
+    echo "Matches in ${matched} of ${searched} iteration log(s)"
+}
 
-    # Level 2: Platform-specific guidelines (skip if placeholder)
-    if [ -f "$platform_prompt_file" ]; then
-        if is_placeholder_file "$platform_prompt_file"; then
-            log "${YELLOW}Note: platform_prompt.txt contains placeholder content - skipping${NC}"
-        else
-            echo "# Level 2: Platform Guidelines"
-            echo ""
-            cat "$platform_prompt_file"
-            echo ""
-            echo "---"
+if [ -n "$GREP_PATTERN" ]; then
+    run_log_grep "$GREP_PATTERN"
+    exit $?
+fi
+
+# Task file is required (an agent test doesn't use it)
+if [ ! -f "$TASK_FILE" ] && [ "$AGENT_TEST" != "true" ]; then
+    echo -e "${RED}ERROR: Task file not found: $TASK_FILE${NC}"
+    exit 1
+fi
+
+# Validate agent is available
+validate_agent() {
+    case "$AGENT_TYPE" in
+        cursor)
+            if ! command -v agent &> /dev/null; then
+                echo -e "${RED}ERROR: Cursor CLI not found!${NC}"
+                echo ""
+                echo "The 'agent' command is required to use Cursor as the AI agent."
+                echo ""
+                echo "To install Cursor CLI:"
+                echo "  1. Open Cursor"
+                echo "  2. Press Cmd+Shift+P (or Ctrl+Shift+P)"
+                echo "  3. Type 'Install cursor command' and select it"
+                echo ""
+                echo "Or switch to a different agent in .ralph/config.sh"
+                exit 1
+            fi
+            ;;
+        auggie)
+            if ! command -v auggie &> /dev/null; then
+                echo -e "${RED}ERROR: Augment CLI not found!${NC}"
+                echo ""
+                echo "The 'auggie' command is required to use Augment as the AI agent."
+                echo ""
+                echo "Visit https://augmentcode.com for installation instructions."
+                echo ""
+                echo "Or switch to a different agent in .ralph/config.sh"
+                exit 1
+            fi
+            ;;
+        custom)
+            if ! type run_agent_custom &> /dev/null; then
+                echo -e "${RED}ERROR: Custom agent selected but run_agent_custom() not defined!${NC}"
+                echo ""
+                echo "Define run_agent_custom() in .ralph/config.sh"
+                echo ""
+                echo "Example:"
+                echo "  run_agent_custom() {"
+                echo "      local prompt=\"\$1\""
+                echo "      local log_file=\"\$2\""
+                echo "      # Your custom agent command here"
+                echo "  }"
+                exit 1
+            fi
+            if ! check_custom_agent_version; then
+                echo -e "${RED}ERROR: ${CUSTOM_AGENT_VERSION_ERROR}${NC}"
+                echo ""
+                echo "Update the agent or change CUSTOM_AGENT_MIN_VERSION in .ralph/config.sh"
+                exit 1
+            fi
+            ;;
+        *)
+            echo -e "${RED}ERROR: Unknown agent type '$AGENT_TYPE'${NC}"
             echo ""
+            echo "Valid options: cursor, auggie, custom"
+            echo "Set AGENT_TYPE in .ralph/config.sh"
+            exit 1
+            ;;
+    esac
+}
+
+# An installed agent can still fail because it isn't logged in. That is
+# only visible in its output, so failed runs are checked for the agent's
+# own login errors. Only the last lines are checked, where the agent reports
+# why it exited, and generic words like "unauthorized" are left out: the
+# project's build and test output earlier in the log can contain them.
+agent_needs_login() {
+    local log_file="$1"
+    local pattern
+
+    case "$AGENT_TYPE" in
+        cursor)
+            pattern="(cursor-)?agent login|CURSOR_API_KEY|authentication required|not (logged|signed) in"
+            ;;
+        auggie)
+            pattern="auggie (--)?login|AUGMENT_SESSION_AUTH|not (logged|signed) in|not authenticated"
+            ;;
+        *)
+            pattern="not (logged|signed) in|not authenticated|login required"
+            ;;
+    esac
+
+    tail -n 10 "$log_file" 2>/dev/null | grep -qiE "$pattern"
+}
+
+# Print how to log in to the current agent (the installed-but-logged-out
+# counterpart to validate_agent's install instructions)
+show_agent_login_help() {
+    log "${RED}The ${AGENT_TYPE} agent is installed but doesn't appear to be logged in.${NC}"
+    case "$AGENT_TYPE" in
+        cursor)
+            log "Log in with:  agent login"
+            ;;
+        auggie)
+            log "Log in with:  auggie login"
+            ;;
+        *)
+            log "Log in to the agent that run_agent_custom() calls, then run Ralph Loop again."
+            ;;
+    esac
+}
+
+# A dry run never calls the agent, so it doesn't need to be installed
+if [ "$DRY_RUN" != "true" ]; then
+    validate_agent
+fi
+
+# Validate build and test scripts exist
+validate_scripts() {
+    local build_script="$RALPH_CONFIG_DIR/build.sh"
+    local test_script="$RALPH_CONFIG_DIR/test.sh"
+    local has_errors=false
+
+    # Check build.sh exists
+    if [ ! -f "$build_script" ]; then
+        echo -e "${RED}ERROR: Build script not found: $build_script${NC}"
+        has_errors=true
+    elif [ ! -x "$build_script" ]; then
+        echo -e "${YELLOW}Warning: Build script is not executable: $build_script${NC}"
+        echo "Making it executable..."
+        chmod +x "$build_script"
+    fi
+
+    # Check test.sh exists
+    if [ ! -f "$test_script" ]; then
+        echo -e "${RED}ERROR: Test script not found: $test_script${NC}"
+        has_errors=true
+    elif [ ! -x "$test_script" ]; then
+        echo -e "${YELLOW}Warning: Test script is not executable: $test_script${NC}"
+        echo "Making it executable..."
+        chmod +x "$test_script"
+    fi
+
+    if [ "$has_errors" = true ]; then
+        echo ""
+        echo "Run the Ralph Loop installer to create missing scripts:"
+        echo "  curl -fsSL https://raw.githubusercontent.com/ralphloopai/ralph-loop/main/install.sh | bash"
+        exit 1
+    fi
+}
+
+if [ "$AGENT_TEST" != "true" ]; then
+    validate_scripts
+fi
+
+#==============================================================================
+# MODEL SELECTION
+#==============================================================================
+
+# Get available models for the current agent
+get_available_models() {
+    case "$AGENT_TYPE" in
+        cursor)
+            # Parse cursor agent models, extracting just the model IDs
+            agent --list-models 2>/dev/null | grep -E "^[a-z]" | awk '{print $1}' | grep -v "^Tip:" | grep -v "^Available"
+            ;;
+        auggie)
+            # Auggie models list (may not be available)
+            auggie models list 2>/dev/null | grep -E "^[a-z]" | awk '{print $1}' || echo "default"
+            ;;
+        *)
+            echo ""
+            ;;
+    esac
+}
+
+# Get the default/current model for the agent
+get_default_model() {
+    case "$AGENT_TYPE" in
+        cursor)
+            # Look for (current) or (default) marker
+            agent --list-models 2>/dev/null | grep -E "\(current\)|\(default\)" | head -1 | awk '{print $1}'
+            ;;
+        auggie)
+            echo "default"
+            ;;
+        *)
+            echo ""
+            ;;
+    esac
+}
+
+# Prompt user to select a model
+select_model() {
+    echo -e "${CYAN}Fetching available models for $AGENT_TYPE...${NC}"
+
+    local models_list=$(get_available_models)
+    local default_model=$(get_default_model)
+
+    if [ -z "$models_list" ] || [ "$models_list" = "default" ]; then
+        echo -e "Using default model for $AGENT_TYPE"
+        SELECTED_MODEL=""
+        return
+    fi
+
+    local model_count=$(echo "$models_list" | wc -l | tr -d ' ')
+
+    echo ""
+    echo -e "${GREEN}Available models ($model_count):${NC}"
+    echo ""
+
+    local i=1
+    local default_index=1
+    while IFS= read -r model; do
+        if [ "$model" = "$default_model" ]; then
+            echo -e "  $i) $model ${YELLOW}(current)${NC}"
+            default_index=$i
+        else
+            echo "  $i) $model"
+        fi
+        ((i++))
+    done <<< "$models_list"
+
+    echo ""
+    echo -en "${CYAN}Select model [$default_index]: ${NC}"
+    read -r model_choice </dev/tty
+
+    if [ -z "$model_choice" ]; then
+        model_choice=$default_index
+    fi
+
+    SELECTED_MODEL=$(echo "$models_list" | sed -n "${model_choice}p")
+
+    if [ -z "$SELECTED_MODEL" ]; then
+        SELECTED_MODEL="$default_model"
+    fi
+
+    echo -e "Selected: ${GREEN}$SELECTED_MODEL${NC}"
+    echo ""
+}
+
+# Switch SELECTED_MODEL to the next unused model in MODEL_FALLBACKS.
+# Returns 1 when there are none left.
+use_next_fallback_model() {
+    local models=($MODEL_FALLBACKS_LEFT)
+
+    if [ ${#models[@]} -eq 0 ]; then
+        return 1
+    fi
+
+    SELECTED_MODEL="${models[0]}"
+    MODEL_FALLBACKS_LEFT="${models[*]:1}"
+}
+
+MODEL_FALLBACKS_LEFT="$MODEL_FALLBACKS"
+
+# Select model if not already set
+if [ "$DRY_RUN" = "true" ]; then
+    SELECTED_MODEL="$DEFAULT_MODEL"
+elif [ -z "$DEFAULT_MODEL" ]; then
+    select_model
+elif [ -n "$MODEL_OVERRIDE" ]; then
+    SELECTED_MODEL="$MODEL_OVERRIDE"
+    echo -e "Using model from --model: ${GREEN}$SELECTED_MODEL${NC}"
+
+    # Typos would otherwise only show up as agent failures
+    available_models=$(get_available_models)
+    if [ -n "$available_models" ] && [ "$available_models" != "default" ] && ! echo "$available_models" | grep -qxF -- "$SELECTED_MODEL"; then
+        echo -e "${YELLOW}Warning: '$SELECTED_MODEL' is not in the models $AGENT_TYPE lists - using it anyway${NC}"
+    fi
+else
+    SELECTED_MODEL="$DEFAULT_MODEL"
+    echo -e "Using configured model: ${GREEN}$SELECTED_MODEL${NC}"
+fi
+
+#==============================================================================
+# SETUP LOGGING
+#==============================================================================
+
+LOG_DIR="$RALPH_CONFIG_DIR/logs"
+mkdir -p "$LOG_DIR"
+
+RUN_ID=$(date +"%Y%m%d_%H%M%S")
+MASTER_LOG="$LOG_DIR/ralph_run_${RUN_ID}.log"
+touch "$MASTER_LOG"
+
+# Secret redaction: a sed script built once from REDACT_SECRETS and
+# REDACT_PATTERNS, applied to everything that goes into the logs
+REDACT_SED=""
+
+build_redact_script() {
+    local script="" name value pattern
+
+    if [ "$REDACT_SECRETS" = "true" ]; then
+        while IFS= read -r name; do
+            value="${!name}"
+            # Short or multi-line values would mask unrelated text
+            if [ ${#value} -lt 8 ] || [[ "$value" == *$'\n'* ]]; then
+                continue
+            fi
+            value=$(printf '%s' "$value" | sed 's/[][\.*^$+?(){}|/]/\\&/g')
+            script+="s/${value}/[REDACTED]/g"$'\n'
+        done < <(compgen -e | grep -E '_(TOKEN|KEY|SECRET)$')
+    fi
+
+    for pattern in "${REDACT_PATTERNS[@]}"; do
+        script+="s/${pattern//\//\\/}/[REDACTED]/g"$'\n'
+    done
+
+    REDACT_SED="$script"
+}
+
+build_redact_script
+
+# Mask secrets in stdin
+redact() {
+    if [ -n "$REDACT_SED" ]; then
+        sed -E "$REDACT_SED"
+    else
+        cat
+    fi
+}
+
+# Mask secrets in a log file, in place
+redact_file() {
+    local file="$1"
+
+    if [ -n "$REDACT_SED" ] && [ -f "$file" ]; then
+        local tmp=$(mktemp)
+        sed -E "$REDACT_SED" "$file" > "$tmp" && cat "$tmp" > "$file"
+        rm -f "$tmp"
+    fi
+}
+
+# Log of the agent that is running, so it still gets redacted when the run
+# stops before the agent returns (Ctrl+C or an error)
+AGENT_LOG_FILE=""
+
+# Mask secrets in the running agent's log
+redact_agent_log() {
+    if [ -n "$AGENT_LOG_FILE" ]; then
+        redact_file "$AGENT_LOG_FILE"
+        AGENT_LOG_FILE=""
+    fi
+}
+
+# Task ID the loop is working on, for JSON log lines
+CURRENT_TASK_ID=""
+
+# Turn stdin into JSON log lines, dropping colors and control characters
+format_json_log() {
+    local level="$1"
+    local timestamp=$(date -u +"%Y-%m-%dT%H:%M:%SZ")
+    local line
+
+    while IFS= read -r line; do
+        line=$(printf '%s' "$line" | sed -E $'s/\x1b\\[[0-9;?]*[A-Za-z]//g' | tr -d '\000-\010\013-\037' \
+            | sed -e 's/\\/\\\\/g' -e 's/"/\\"/g' -e $'s/\t/\\\\t/g')
+        if [ -z "$line" ]; then
+            continue
+        fi
+        printf '{"timestamp":"%s","level":"%s","run_id":"%s","task_id":"%s","message":"%s"}\n' \
+            "$timestamp" "$level" "$RUN_ID" "$CURRENT_TASK_ID" "$line"
+    done
+}
+
+# Turn stdin into the contents of a JSON string: secrets masked, colors and
+# control characters dropped, newlines kept as \n
+json_escape() {
+    redact | sed -E $'s/\x1b\\[[0-9;?]*[A-Za-z]//g' | tr -d '\000-\010\013-\037' \
+        | sed -e 's/\\/\\\\/g' -e 's/"/\\"/g' -e $'s/\t/\\\\t/g' \
+        | awk '{ printf "%s%s", (NR > 1 ? "\\n" : ""), $0 }'
+}
+
+# With LOG_PROMPTS, append one agent call to logs/prompts_<run id>.jsonl
+log_prompt() {
+    local prompt="$1"
+    local log_file="$2"
+    local kind="$3"
+
+    if [ "$LOG_PROMPTS" != "true" ]; then
+        return 0
+    fi
+
+    local timestamp=$(date -u +"%Y-%m-%dT%H:%M:%SZ")
+    printf '{"timestamp":"%s","run_id":"%s","task_id":"%s","iteration":%d,"kind":"%s","agent":"%s","model":"%s","exit_code":%d,"prompt":"%s","response":"%s"}\n' \
+        "$timestamp" "$RUN_ID" "$CURRENT_TASK_ID" "${iteration:-0}" "$kind" "$AGENT_TYPE" "${SELECTED_MODEL:-default}" "${AGENT_EXIT_CODE:-0}" \
+        "$(printf '%s\n' "$prompt" | json_escape)" \
+        "$(truncate_output "$log_file" "$LOG_PROMPTS_RESPONSE_LINES" | json_escape)" \
+        >> "$LOG_DIR/prompts_${RUN_ID}.jsonl"
+}
+
+log() {
+    if [ "$LOG_FORMAT" = "json" ]; then
+        echo -e "$1" | redact
+        log_only "$1"
+    else
+        echo -e "$1" | redact | tee -a "$MASTER_LOG"
+    fi
+}
+
+log_only() {
+    if [ "$LOG_FORMAT" = "json" ]; then
+        local level="info"
+        case "$1" in
+            *"$RED"*) level="error" ;;
+            *"$YELLOW"*) level="warning" ;;
+        esac
+        echo -e "$1" | redact | format_json_log "$level" >> "$MASTER_LOG"
+    else
+        echo -e "$1" | redact >> "$MASTER_LOG"
+    fi
+}
+
+#==============================================================================
+# BRANCH VERIFICATION
+#==============================================================================
+
+verify_branch() {
+    if [ "$REQUIRE_BRANCH" != "true" ]; then
+        return 0
+    fi
+    
+    cd "$PROJECT_DIR"
+    local current_branch=$(git rev-parse --abbrev-ref HEAD 2>/dev/null || echo "")
+    
+    if [ -z "$current_branch" ]; then
+        log "${RED}ERROR: Not a git repository: $PROJECT_DIR${NC}"
+        exit 1
+    fi
+    
+    # Check if on main/master (not allowed)
+    if [ "$current_branch" = "main" ] || [ "$current_branch" = "master" ]; then
+        log "${RED}ERROR: Cannot run on '$current_branch' branch${NC}"
+        log "${YELLOW}Create a feature branch first: git checkout -b feature/my-feature${NC}"
+        exit 1
+    fi
+    
+    # Check allowed branches if specified
+    if [ -n "$ALLOWED_BRANCHES" ]; then
+        if ! echo "$ALLOWED_BRANCHES" | grep -qw "$current_branch"; then
+            log "${RED}ERROR: Branch '$current_branch' not in allowed list${NC}"
+            log "${YELLOW}Allowed branches: $ALLOWED_BRANCHES${NC}"
+            exit 1
+        fi
+    fi
+    
+    log "${GREEN}✓ On branch: $current_branch${NC}"
+    cd - > /dev/null
+}
+
+#==============================================================================
+# BUILD PROMPT (3-Level System)
+#==============================================================================
+#
+# Prompts are combined from 3 levels:
+#   1. Global (base_prompt.txt) - Ralph Loop workflow instructions
+#   2. Platform (.ralph/platform_prompt.txt) - Platform guidelines
+#   3. Project (.ralph/project_prompt.txt) - Project-specific instructions
+#
+# Placeholder files (containing "<!-- PLACEHOLDER:") are skipped.
+# Each level can be edited independently without affecting the others.
+#
+
+# Check if a file contains placeholder content (not yet configured)
+is_placeholder_file() {
+    local file="$1"
+    if [ ! -f "$file" ]; then
+        return 1
+    fi
+    grep -q "<!-- PLACEHOLDER:" "$file" 2>/dev/null
+}
+
+# Reference docs from DOCS_PATTERNS, each under its own heading, capped at
+# DOCS_MAX_BYTES in total. Files past the cap are listed but not included.
+build_docs_context() {
+    if [ "$DOCS_MAX_BYTES" -eq 0 ]; then
+        return 0
+    fi
+
+    local used=0 skipped=() pattern file size
+    cd "$PROJECT_DIR"
+    for pattern in "${DOCS_PATTERNS[@]}"; do
+        for file in $pattern; do
+            if [ ! -f "$file" ]; then
+                continue
+            fi
+            size=$(wc -c < "$file" | tr -d ' ')
+            if [ $((used + size)) -gt "$DOCS_MAX_BYTES" ]; then
+                skipped+=("$file")
+                continue
+            fi
+            used=$((used + size))
+            echo "## $file"
+            echo ""
+            cat "$file"
+            echo ""
+        done
+    done
+    cd - > /dev/null
+
+    if [ ${#skipped[@]} -gt 0 ]; then
+        echo "Not included (over the ${DOCS_MAX_BYTES}-byte docs limit), read them if relevant:"
+        printf -- '- %s\n' "${skipped[@]}"
+    fi
+}
+
+# File-level summary of the commits made so far in this run
+build_previous_changes() {
+    if [ "$PREVIOUS_CHANGES_MAX_LINES" -eq 0 ] || [ -z "$RUN_START_HEAD" ]; then
+        return 0
+    fi
+
+    local logs_path="${LOG_DIR#$PROJECT_DIR/}"
+    local changes=$(git -C "$PROJECT_DIR" log --stat --format='%h %s' "$RUN_START_HEAD..HEAD" -- . ":(exclude)$logs_path" 2>/dev/null)
+    if [ -z "$changes" ]; then
+        return 0
+    fi
+
+    local total=$(echo "$changes" | wc -l | tr -d ' ')
+    echo "$changes" | head -n "$PREVIOUS_CHANGES_MAX_LINES"
+    if [ "$total" -gt "$PREVIOUS_CHANGES_MAX_LINES" ]; then
+        echo "... ($((total - PREVIOUS_CHANGES_MAX_LINES)) more lines; see git log $(git -C "$PROJECT_DIR" rev-parse --short "$RUN_START_HEAD")..HEAD)"
+    fi
+}
+
+# Prompt template for a task line: .ralph/prompts/<name>.txt for
+# "[template: <name>]", else .ralph/prompts/default.txt, else nothing
+get_task_template_file() {
+    local task="$1"
+    local prompts_dir="$RALPH_CONFIG_DIR/prompts"
+    local name=$(echo "$task" | sed -nE 's/.*\[template:[[:space:]]*([A-Za-z0-9_-]+)[[:space:]]*\].*/\1/p')
+
+    if [ -n "$name" ]; then
+        if [ -f "$prompts_dir/$name.txt" ]; then
+            echo "$prompts_dir/$name.txt"
+            return 0
+        fi
+        log "${YELLOW}Note: prompt template '$name' not found in .ralph/prompts/ - using the default${NC}" >&2
+    fi
+
+    if [ -f "$prompts_dir/default.txt" ]; then
+        echo "$prompts_dir/default.txt"
+    fi
+}
+
+build_prompt() {
+    local base_prompt_file="$RALPH_DIR/base_prompt.txt"
+    local platform_prompt_file="$RALPH_CONFIG_DIR/platform_prompt.txt"
+    local project_prompt_file="$RALPH_CONFIG_DIR/project_prompt.txt"
+
+    # Level 1: Global/Ralph Loop instructions
+    if [ -f "$base_prompt_file" ]; then
+        echo "# Level 1: Ralph Loop Instructions"
+        echo ""
+        cat "$base_prompt_file"
+        echo ""
+        echo "---"
+        echo ""
+    fi
+
+    # Level 2: Platform-specific guidelines (skip if placeholder)
+    if [ -f "$platform_prompt_file" ]; then
+        if is_placeholder_file "$platform_prompt_file"; then
+            log "${YELLOW}Note: platform_prompt.txt contains placeholder content - skipping${NC}"
+        else
+            echo "# Level 2: Platform Guidelines"
+            echo ""
+            cat "$platform_prompt_file"
+            echo ""
+            echo "---"
+            echo ""
+        fi
+    fi
+
+    # Level 3: Project-specific instructions (skip if placeholder)
+    if [ -f "$project_prompt_file" ]; then
+        if is_placeholder_file "$project_prompt_file"; then
+            log "${YELLOW}Note: project_prompt.txt contains placeholder content - skipping${NC}"
+        else
+            echo "# Level 3: Project-Specific Instructions"
+            echo ""
+            cat "$project_prompt_file"
+        fi
+    fi
+
+    # Reference documentation (DOCS_PATTERNS)
+    local docs_context=$(build_docs_context)
+    if [ -n "$docs_context" ]; then
+        echo ""
+        echo "---"
+        echo ""
+        echo "# Reference Documentation"
+        echo ""
+        echo "$docs_context"
+    fi
+
+    # What earlier tasks in this run changed
+    local previous_changes=$(build_previous_changes)
+    if [ -n "$previous_changes" ]; then
+        echo ""
+        echo "---"
+        echo ""
+        echo "# Changes Made Earlier in This Run"
+        echo ""
+        echo "Commits from previous tasks, newest first. Build on them rather than redoing them."
+        echo ""
+        echo "$previous_changes"
+    fi
+
+    # Task-type instructions from .ralph/prompts/ (e.g. [template: bugfix])
+    local task_template_file=$(get_task_template_file "$(get_next_task)")
+    if [ -n "$task_template_file" ]; then
+        echo ""
+        echo "---"
+        echo ""
+        echo "# Task Type Instructions ($(basename "$task_template_file" .txt))"
+        echo ""
+        cat "$task_template_file"
+    fi
+
+    # With a tag filter or priorities the next task may not be the first
+    # unchecked one, so name it explicitly
+    local next_task=$(get_next_task)
+    local first_unchecked=$(grep "^\- \[ \]" "$TASK_FILE" 2>/dev/null | head -1 | sed -E 's/- \[ \] //')
+    if [ -n "$next_task" ] && [ "$next_task" != "$first_unchecked" ]; then
+        echo ""
+        echo "---"
+        echo ""
+        echo "# Assigned Task"
+        echo ""
+        echo "Tasks in this run are picked by filter and priority. Work on this task instead of the"
+        echo "first unchecked one, and leave the other tasks unchecked:"
+        echo ""
+        echo "$next_task"
+    fi
+
+    # Files the task is allowed to change ([paths: ...])
+    local allowed_paths=$(get_task_allowed_paths "$next_task")
+    if [ -n "$allowed_paths" ]; then
+        echo ""
+        echo "---"
+        echo ""
+        echo "# Allowed Paths"
+        echo ""
+        echo "Only change files matching these paths for this task (plus the task file to check it off)."
+        echo "Changes anywhere else will fail verification:"
+        echo ""
+        echo "$allowed_paths" | sed 's/^/- /'
+    fi
+
+    # Extra context gathered by the pre_task hook for this iteration
+    if [ -n "$PRE_TASK_HOOK_OUTPUT" ]; then
+        echo ""
+        echo "---"
+        echo ""
+        echo "# Additional Context (from pre_task hook)"
+        echo ""
+        echo "$PRE_TASK_HOOK_OUTPUT"
+    fi
+}
+
+#==============================================================================
+# AGENT COMMANDS
+#==============================================================================
+
+# Progress monitor - runs in background to show activity
+# Uses ANSI escape codes to update multiple lines in place
+start_progress_monitor() {
+    local log_file="$1"
+    local start_time=$(date +%s)
+    local spinner_chars='⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏'
+    local spinner_idx=0
+
+    # Hide cursor
+    printf "\033[?25l"
+
+    while true; do
+        sleep 1
+
+        local elapsed=$(($(date +%s) - start_time))
+        local mins=$((elapsed / 60))
+        local secs=$((elapsed % 60))
+
+        # Count modified files
+        local changed_files=$(git status --porcelain 2>/dev/null | wc -l | tr -d ' ')
+
+        # Get last meaningful line from log (skip empty lines)
+        local last_line=""
+        if [ -f "$log_file" ]; then
+            last_line=$(tail -20 "$log_file" 2>/dev/null | grep -v '^$' | tail -1 | redact | head -c 60)
+        fi
+
+        # Spinner animation
+        local spinner="${spinner_chars:$spinner_idx:1}"
+        spinner_idx=$(( (spinner_idx + 1) % ${#spinner_chars} ))
+
+        # Move cursor up 3 lines, clear them, and redraw
+        # (On first iteration, these lines don't exist yet, but that's OK)
+        printf "\033[3A\033[J"
+
+        # Line 1: Status with spinner
+        printf "${CYAN}%s Agent working...${NC}\n" "$spinner"
+
+        # Line 2: Stats
+        printf "  ${YELLOW}⏱${NC}  %02d:%02d elapsed  ${YELLOW}📁${NC}  %d files changed\n" "$mins" "$secs" "$changed_files"
+
+        # Line 3: Last output (truncated) or status message
+        if [ -n "$last_line" ]; then
+            printf "  ${YELLOW}💬${NC}  %.60s\n" "$last_line"
+        else
+            # No output yet - agent is initializing or thinking
+            local thinking_msgs=("Agent is thinking..." "Processing request..." "Analyzing codebase..." "Preparing response...")
+            local msg_idx=$(( (elapsed / 5) % 4 ))
+            printf "  ${YELLOW}💬${NC}  ${thinking_msgs[$msg_idx]}\n"
+        fi
+    done
+}
+
+stop_progress_monitor() {
+    if [ -n "$PROGRESS_PID" ] && kill -0 "$PROGRESS_PID" 2>/dev/null; then
+        kill "$PROGRESS_PID" 2>/dev/null
+        wait "$PROGRESS_PID" 2>/dev/null
+    fi
+    # Show cursor again
+    printf "\033[?25h"
+    # Clear the progress lines
+    printf "\033[3A\033[J"
+}
+
+# Output stream - runs in background to print new log lines as they arrive.
+# On TERM it prints whatever is left before exiting, so no output is lost.
+start_output_stream() {
+    local log_file="$1"
+    local shown=0
+
+    print_new_lines() {
+        [ -f "$log_file" ] || return 0
+        local total=$(wc -l < "$log_file" | tr -d ' ')
+        if [ "$total" -gt "$shown" ]; then
+            sed -n "$((shown + 1)),${total}p" "$log_file" | redact
+            shown=$total
+        fi
+    }
+
+    trap 'print_new_lines; exit 0' TERM
+
+    while true; do
+        print_new_lines
+        sleep 1
+    done
+}
+
+# Show agent activity while it runs: live output or the progress monitor
+start_agent_display() {
+    local log_file="$1"
+
+    if [ "$STREAM_AGENT_OUTPUT" = "true" ]; then
+        start_output_stream "$log_file" &
+        PROGRESS_PID=$!
+        return
+    fi
+
+    # Print 3 blank lines for the progress monitor to use
+    echo ""
+    echo ""
+    echo ""
+
+    # Start progress monitor in background
+    start_progress_monitor "$log_file" &
+    PROGRESS_PID=$!
+}
+
+stop_agent_display() {
+    if [ "$STREAM_AGENT_OUTPUT" = "true" ]; then
+        if [ -n "$PROGRESS_PID" ] && kill -0 "$PROGRESS_PID" 2>/dev/null; then
+            kill "$PROGRESS_PID" 2>/dev/null
+            wait "$PROGRESS_PID" 2>/dev/null
+        fi
+        echo ""
+        return
+    fi
+
+    stop_progress_monitor
+}
+
+# Get a file's modification time in epoch seconds (GNU and BSD stat)
+get_file_mtime() {
+    stat -c %Y "$1" 2>/dev/null || stat -f %m "$1" 2>/dev/null
+}
+
+# Seconds between checks on a running agent's stuck and timeout limits
+WATCH_INTERVAL_SECONDS=5
+
+# Check a process every interval seconds while it runs, and kill it (and
+# anything it started) as soon as the check command succeeds.
+# Returns 0 if it was killed, 1 if it exited on its own.
+watch_process() {
+    local pid="$1"
+    local interval="$2"
+    shift 2
+
+    while kill -0 "$pid" 2>/dev/null; do
+        sleep "$interval"
+        if kill -0 "$pid" 2>/dev/null && "$@"; then
+            kill_process_tree "$pid"
+            return 0
+        fi
+    done
+    return 1
+}
+
+# True once the epoch time deadline has passed
+deadline_passed() {
+    [ "$(date +%s)" -ge "$1" ]
+}
+
+# True if a file hasn't been written to for timeout_secs, counting from
+# since (epoch seconds) if it is older than that
+file_idle_for() {
+    local file="$1"
+    local since="$2"
+    local timeout_secs="$3"
+    local last_activity=$(get_file_mtime "$file")
+
+    if [ -z "$last_activity" ] || [ "$last_activity" -lt "$since" ]; then
+        last_activity=$since
+    fi
+    [ $(($(date +%s) - last_activity)) -ge "$timeout_secs" ]
+}
+
+# Stuck detection - runs in background alongside the agent
+# Kills the agent if its log has not been written to for STUCK_TIMEOUT_MINUTES.
+# An ERROR marker is appended so the loop counts it as a failed iteration.
+start_stuck_watchdog() {
+    local agent_pid="$1"
+    local log_file="$2"
+
+    if watch_process "$agent_pid" "$WATCH_INTERVAL_SECONDS" file_idle_for "$log_file" "$(date +%s)" $((STUCK_TIMEOUT_MINUTES * 60)); then
+        echo "" >> "$log_file"
+        echo "ERROR: Agent stuck - no output for ${STUCK_TIMEOUT_MINUTES}m" >> "$log_file"
+    fi
+}
+
+# Name of the setting that limits the current agent's run time: its own
+# <AGENT>_TIMEOUT_MINUTES if set, otherwise AGENT_TIMEOUT_MINUTES
+get_agent_timeout_setting() {
+    local name
+    case "$AGENT_TYPE" in
+        cursor) name="CURSOR_TIMEOUT_MINUTES" ;;
+        auggie) name="AUGGIE_TIMEOUT_MINUTES" ;;
+        *) name="CUSTOM_AGENT_TIMEOUT_MINUTES" ;;
+    esac
+
+    if [ -n "${!name}" ]; then
+        echo "$name"
+    else
+        echo "AGENT_TIMEOUT_MINUTES"
+    fi
+}
+
+# Minutes the current agent may run (0 = no limit)
+get_agent_timeout_minutes() {
+    local name=$(get_agent_timeout_setting)
+    echo "${!name:-0}"
+}
+
+# Kills the agent (and anything it started) once it has run for its
+# timeout, whatever the agent does with its own timeouts.
+# The ERROR marker makes the iteration count as a failure.
+start_agent_timeout() {
+    local agent_pid="$1"
+    local log_file="$2"
+    local timeout_minutes="$3"
+    local deadline=$(($(date +%s) + timeout_minutes * 60))
+
+    if watch_process "$agent_pid" "$WATCH_INTERVAL_SECONDS" deadline_passed "$deadline"; then
+        echo "" >> "$log_file"
+        echo "ERROR: Agent timed out after ${timeout_minutes}m" >> "$log_file"
+    fi
+}
+
+# PID of the agent being waited on, so an interrupt can stop it
+AGENT_PID=""
+
+# Wait for a backgrounded agent process, enforcing stuck detection and
+# the overall agent timeout
+wait_for_agent() {
+    local agent_pid="$1"
+    local log_file="$2"
+    local watchdog_pid=""
+    local timeout_pid=""
+
+    if [ "${STUCK_TIMEOUT_MINUTES:-0}" -gt 0 ]; then
+        start_stuck_watchdog "$agent_pid" "$log_file" &
+        watchdog_pid=$!
+    fi
+    local timeout_minutes=$(get_agent_timeout_minutes)
+    if [ "$timeout_minutes" -gt 0 ]; then
+        start_agent_timeout "$agent_pid" "$log_file" "$timeout_minutes" &
+        timeout_pid=$!
+    fi
+
+    AGENT_PID="$agent_pid"
+    wait "$agent_pid"
+    local exit_code=$?
+    AGENT_PID=""
+
+    if [ -n "$watchdog_pid" ] && kill -0 "$watchdog_pid" 2>/dev/null; then
+        kill "$watchdog_pid" 2>/dev/null
+        wait "$watchdog_pid" 2>/dev/null
+    fi
+    if [ -n "$timeout_pid" ] && kill -0 "$timeout_pid" 2>/dev/null; then
+        kill "$timeout_pid" 2>/dev/null
+        wait "$timeout_pid" 2>/dev/null
+    fi
+
+    return $exit_code
+}
+
+# Show summary after agent completes
+show_agent_summary() {
+    local log_file="$1"
+    local start_time="$2"
+    local end_time=$(date +%s)
+    local elapsed=$((end_time - start_time))
+    local mins=$((elapsed / 60))
+    local secs=$((elapsed % 60))
+
+    # Count changes
+    local changed_files=$(git status --porcelain 2>/dev/null | wc -l | tr -d ' ')
+    local lines_in_log=$(wc -l < "$log_file" 2>/dev/null | tr -d ' ')
+
+    echo -e "${GREEN}✓ Agent completed in ${mins}m ${secs}s${NC}"
+    echo -e "  Files changed: $changed_files | Log lines: $lines_in_log"
+}
+
+# Default agent commands - can be overridden in config.sh
+run_agent_cursor() {
+    local prompt="$1"
+    local log_file="$2"
+    local start_time=$(date +%s)
+
+    if ! command -v agent &> /dev/null; then
+        log "${RED}ERROR: 'agent' command not found. Please install Cursor CLI.${NC}"
+        return 1
+    fi
+
+    start_agent_display "$log_file"
+
+    # Run agent, output goes to log file only (progress monitor shows status)
+    # --force allows agents to run shell commands within their tasks
+    if [ -n "$SELECTED_MODEL" ]; then
+        echo "$prompt" | agent --print --force --model "$SELECTED_MODEL" > "$log_file" 2>&1 &
+    else
+        echo "$prompt" | agent --print --force > "$log_file" 2>&1 &
+    fi
+    wait_for_agent $! "$log_file"
+    local exit_code=$?
+
+    # Stop progress monitor and show summary
+    stop_agent_display
+    show_agent_summary "$log_file" "$start_time"
+
+    return $exit_code
+}
+
+run_agent_auggie() {
+    local prompt="$1"
+    local log_file="$2"
+    local start_time=$(date +%s)
+
+    if ! command -v auggie &> /dev/null; then
+        log "${RED}ERROR: 'auggie' command not found. Please install Augment CLI.${NC}"
+        return 1
+    fi
+
+    start_agent_display "$log_file"
+
+    # Run agent, output goes to log file only
+    if [ -n "$SELECTED_MODEL" ] && [ "$SELECTED_MODEL" != "default" ]; then
+        auggie --print --quiet --model "$SELECTED_MODEL" "$prompt" > "$log_file" 2>&1 &
+    else
+        auggie --print --quiet "$prompt" > "$log_file" 2>&1 &
+    fi
+    wait_for_agent $! "$log_file"
+    local exit_code=$?
+
+    # Stop progress monitor and show summary
+    stop_agent_display
+    show_agent_summary "$log_file" "$start_time"
+
+    return $exit_code
+}
+
+# Expand ${VAR} references in a CUSTOM_AGENT_ENV value from the environment
+expand_env_value() {
+    local value="$1"
+    local result=""
+    while [[ "$value" =~ ^([^$]*)\$\{([A-Za-z_][A-Za-z0-9_]*)\}(.*)$ ]]; do
+        local name="${BASH_REMATCH[2]}"
+        result+="${BASH_REMATCH[1]}${!name}"
+        value="${BASH_REMATCH[3]}"
+    done
+    echo "${result}${value}"
+}
+
+# Run run_agent_custom with CUSTOM_AGENT_ENV exported to it
+run_agent_custom_with_env() {
+    (
+        local entry
+        for entry in "${CUSTOM_AGENT_ENV[@]}"; do
+            export "${entry%%=*}=$(expand_env_value "${entry#*=}")"
+        done
+        run_agent_custom "$@"
+    )
+}
+
+run_agent() {
+    local log_file="$1"
+    local prompt_override="$2"  # Optional: e.g. a fix or review prompt
+    local kind="${3:-task}"     # For LOG_PROMPTS: task, build_fix, test_fix, verify_fix, scope_fix, review or agent_test
+
+    AGENT_EXIT_CODE=0
+
+    local prompt
+    if [ -n "$prompt_override" ]; then
+        prompt="$prompt_override"
+    else
+        prompt=$(build_prompt)
+    fi
+
+    cd "$PROJECT_DIR"
+
+    AGENT_LOG_FILE="$log_file"
+    set +e  # Temporarily disable exit on error
+
+    case "$AGENT_TYPE" in
+        cursor)
+            run_agent_cursor "$prompt" "$log_file"
+            ;;
+        auggie)
+            run_agent_auggie "$prompt" "$log_file"
+            ;;
+        custom)
+            # Custom agent command should be defined in config.sh as run_agent_custom()
+            if type run_agent_custom &> /dev/null; then
+                # In the background like the built-in agents, so timeouts,
+                # stuck detection and interrupts apply to it too
+                run_agent_custom_with_env "$prompt" "$log_file" &
+                wait_for_agent $! "$log_file"
+            else
+                log "${RED}ERROR: Custom agent selected but run_agent_custom() not defined in config.sh${NC}"
+                set -e
+                return 1
+            fi
+            ;;
+        *)
+            log "${RED}ERROR: Unknown agent type '$AGENT_TYPE'. Use 'cursor', 'auggie', or 'custom'.${NC}"
+            set -e
+            return 1
+            ;;
+    esac
+
+    local agent_exit=$?
+    AGENT_EXIT_CODE=$agent_exit
+    set -e
+
+    redact_agent_log
+    log_prompt "$prompt" "$log_file" "$kind"
+
+    cd - > /dev/null
+    return 0  # We check log content, not exit code
+}
+
+#==============================================================================
+# TASK COUNTING
+#==============================================================================
+
+# Tags on a task line, one per line: "- [ ] TASK-001: Add API [tags: backend, db]"
+get_task_tags() {
+    echo "$1" | sed -nE 's/.*\[tags:([^]]*)\].*/\1/p' | tr ',' '\n' | sed -E 's/^[[:space:]]+//; s/[[:space:]]+$//' | grep -v '^$'
+}
+
+# Paths a task may change, one glob per line: "[paths: src/api/*, docs/*]"
+get_task_allowed_paths() {
+    echo "$1" | sed -nE 's/.*\[paths:([^]]*)\].*/\1/p' | tr ',' '\n' | sed -E 's/^[[:space:]]+//; s/[[:space:]]+$//' | grep -v '^$'
+}
+
+# True when --tags, --exclude-tags or --only limits which tasks run
+task_filter_active() {
+    [ -n "$TAG_FILTER" ] || [ -n "$EXCLUDE_TAG_FILTER" ] || [ -n "$ONLY_TASKS" ]
+}
+
+# Check a task line against --only / --tags / --exclude-tags
+task_matches_filter() {
+    local line="$1"
+    if ! task_filter_active; then
+        return 0
+    fi
+
+    local tags=$(get_task_tags "$line")
+    local tag
+
+    if [ -n "$ONLY_TASKS" ]; then
+        local task="${line#- \[ \] }"
+        local id="${task%%:*}" only only_match=false
+        for only in ${ONLY_TASKS//,/ }; do
+            if [ "$only" = "$id" ]; then
+                only_match=true
+                break
+            fi
+        done
+        if [ "$only_match" = "false" ]; then
+            return 1
+        fi
+    fi
+
+    if [ -n "$EXCLUDE_TAG_FILTER" ]; then
+        for tag in ${EXCLUDE_TAG_FILTER//,/ }; do
+            if echo "$tags" | grep -qxF "$tag"; then
+                return 1
+            fi
+        done
+    fi
+
+    if [ -n "$TAG_FILTER" ]; then
+        for tag in ${TAG_FILTER//,/ }; do
+            if echo "$tags" | grep -qxF "$tag"; then
+                return 0
+            fi
+        done
+        return 1
+    fi
+
+    return 0
+}
+
+# Task IDs skipped at the approval prompt; they stay unchecked in TASKS.md
+SKIPPED_TASK_IDS=()
+
+# Tasks reported as blocked ("BLOCKED: reason" from the agent or the
+# pre_task hook) are set aside for the rest of the run. Not failures.
+BLOCKED_TASK_IDS=()
+BLOCKED_TASK_REASONS=()
+
+block_task() {
+    BLOCKED_TASK_IDS+=("$1")
+    BLOCKED_TASK_REASONS+=("$2")
+}
+
+# First "BLOCKED: reason" line in a file, without the marker
+get_blocked_reason() {
+    local line=$(get_status_line BLOCKED "$(cat "$1" 2>/dev/null)")
+    local keyword
+    for keyword in "${STATUS_KEYWORDS_BLOCKED[@]}"; do
+        if [ -n "$keyword" ] && [[ "$line" == "$keyword"* ]]; then
+            line="${line#"$keyword"}"
+            break
+        fi
+    done
+    echo "$line" | sed -E 's/^[[:space:]]*//'
+}
+
+# True for tasks skipped or blocked earlier in this run
+task_was_skipped() {
+    local line="${1#- \[ \] }"
+    local id="${line%%:*}" skipped
+    for skipped in "${SKIPPED_TASK_IDS[@]}" "${BLOCKED_TASK_IDS[@]}"; do
+        if [ "$skipped" = "$id" ]; then
+            return 0
+        fi
+    done
+    return 1
+}
+
+# Unchecked tasks that pass the tag filter, in file order.
+# Filtered-out and skipped tasks are left out, not reordered.
+get_pending_tasks() {
+    local line
+    grep "^\- \[ \]" "$TASK_FILE" 2>/dev/null | while IFS= read -r line; do
+        if task_matches_filter "$line" && ! task_was_skipped "$line"; then
+            echo "$line"
+        fi
+    done
+}
+
+# Tasks marked [skip-verify] (e.g. docs-only work) bypass the build, test
+# and verify gates, and so never trigger fix attempts
+task_skips_verify() {
+    echo "$1" | grep -q "\[skip-verify\]"
+}
+
+# N from a task's [fix-attempts: N], or nothing
+get_task_fix_attempts() {
+    echo "$1" | sed -nE 's/.*\[fix-attempts:[[:space:]]*([0-9]+)[[:space:]]*\].*/\1/p'
+}
+
+# grep -c prints 0 itself (but exits 1) when nothing matches
+count_remaining() {
+    local count
+    count=$(get_pending_tasks | grep -c .) || true
+    echo "${count:-0}"
+}
+
+# Like count_remaining, but also counting tasks skipped or blocked this run
+count_unfinished() {
+    local line count=0
+    while IFS= read -r line; do
+        if [ -n "$line" ] && task_matches_filter "$line"; then
+            count=$((count + 1))
+        fi
+    done <<< "$(grep "^\- \[ \]" "$TASK_FILE" 2>/dev/null)"
+    echo "$count"
+}
+
+count_completed() {
+    local count
+    count=$(grep -c "^\- \[x\]" "$TASK_FILE" 2>/dev/null) || true
+    echo "${count:-0}"
+}
+
+# Highest-priority pending task; ties go to the one earlier in the file.
+# [priority: high|medium|low] map to 3/2/1, numbers are used as given,
+# and tasks without a priority count as medium.
+get_next_task() {
+    get_pending_tasks | awk '
+        {
+            priority = 2
+            if (match($0, /\[priority:[[:space:]]*[A-Za-z0-9-]+[[:space:]]*\]/)) {
+                value = tolower(substr($0, RSTART + 10, RLENGTH - 11))
+                gsub(/[[:space:]]/, "", value)
+                if (value == "high") priority = 3
+                else if (value == "low") priority = 1
+                else if (value ~ /^-?[0-9]+$/) priority = value + 0
+            }
+            if (NR == 1 || priority > best) { best = priority; line = $0 }
+        }
+        END { if (NR) print line }
+    ' | sed -E 's/- \[ \] //'
+}
+
+# Whether a task is checked off in the task file. With priorities and
+# filters, the task that just finished isn't necessarily the last [x] line.
+task_is_checked() {
+    grep -qF -- "- [x] $1:" "$TASK_FILE"
+}
+
+# Warn when the agent reports a task done without checking it off
+check_task_completed() {
+    if ! task_is_checked "$1"; then
+        log "${YELLOW}⚠ ${1} is not checked off in $(basename "$TASK_FILE") - it will be offered again${NC}"
+    fi
+}
+
+#==============================================================================
+# STATUS MARKERS
+#==============================================================================
+
+# Extended regex matching any of a status's STATUS_KEYWORDS_<status>
+# phrases where that status is expected on a line
+status_pattern() {
+    local status="$1"
+    local keyword alternatives=""
+    while IFS= read -r keyword; do
+        [ -n "$keyword" ] || continue
+        alternatives="${alternatives:+$alternatives|}$(printf '%s' "$keyword" | sed 's/[][\.*^$+?(){}|]/\\&/g')"
+    done < <(eval 'printf "%s\n" "${STATUS_KEYWORDS_'"$status"'[@]}"')
+
+    case "$status" in
+        ERROR) echo "($alternatives)" ;;
+        BLOCKED) echo "^($alternatives)" ;;
+        *) echo "($alternatives)\$" ;;
+    esac
+}
+
+# True if the agent output carries the status marker
+output_has_status() {
+    printf '%s\n' "$2" | grep -qE "$(status_pattern "$1")"
+}
+
+# First line of the agent output carrying the status marker
+get_status_line() {
+    printf '%s\n' "$2" | grep -m1 -E "$(status_pattern "$1")"
+}
+
+#==============================================================================
+# BUILD VERIFICATION
+#==============================================================================
+
+# Print up to N lines of a file, keeping the lines OUTPUT_TRUNCATION selects
+truncate_output() {
+    local file="$1"
+    local lines="$2"
+    local total=$(wc -l < "$file" | tr -d ' ')
+
+    if [ "$total" -le "$lines" ]; then
+        cat "$file"
+        return 0
+    fi
+
+    case "$OUTPUT_TRUNCATION" in
+        head)
+            head -n "$lines" "$file"
+            ;;
+        both)
+            local head_lines=$(((lines + 1) / 2))
+            head -n "$head_lines" "$file"
+            echo "... ($((total - lines)) lines omitted) ..."
+            tail -n "$((lines - head_lines))" "$file"
+            ;;
+        *)
+            tail -n "$lines" "$file"
+            ;;
+    esac
+}
+
+# Heading for truncated output, e.g. "last 20 lines"
+describe_truncation() {
+    case "$OUTPUT_TRUNCATION" in
+        head) echo "first $1 lines" ;;
+        both) echo "$1 lines from the start and end" ;;
+        *) echo "last $1 lines" ;;
+    esac
+}
+
+# Build/test progress spinner - runs in background
+BUILD_SPINNER_PID=""
+
+start_build_spinner() {
+    local label="$1"
+    local spinner_chars='⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏'
+    local spinner_idx=0
+    local start_time=$(date +%s)
+
+    # Hide cursor
+    printf "\033[?25l"
+
+    while true; do
+        sleep 0.5
+        local elapsed=$(($(date +%s) - start_time))
+        local mins=$((elapsed / 60))
+        local secs=$((elapsed % 60))
+
+        local spinner="${spinner_chars:$spinner_idx:1}"
+        spinner_idx=$(( (spinner_idx + 1) % ${#spinner_chars} ))
+
+        # Clear line and show spinner with elapsed time
+        printf "\r\033[K${CYAN}%s %s${NC} %02d:%02d" "$spinner" "$label" "$mins" "$secs"
+    done
+}
+
+stop_build_spinner() {
+    if [ -n "$BUILD_SPINNER_PID" ] && kill -0 "$BUILD_SPINNER_PID" 2>/dev/null; then
+        kill "$BUILD_SPINNER_PID" 2>/dev/null
+        # The killed spinner exits 143; don't let set -e treat that as a failure
+        wait "$BUILD_SPINNER_PID" 2>/dev/null || true
+    fi
+    BUILD_SPINNER_PID=""
+    # Show cursor and clear line
+    printf "\033[?25h\r\033[K"
+}
+
+# With VERIFY_PARALLEL, the gates run together up front and verify_build,
+# verify_tests and verify_custom pick up their results instead of running
+# the scripts again. Each gate's output goes to its own file.
+PARALLEL_GATE_DIR=""
+
+run_gates_in_parallel() {
+    discard_parallel_results
+
+    local gates=()
+    if [ "$BUILD_GATE_ENABLED" = "true" ]; then
+        gates+=(build)
+    fi
+    if [ "$TEST_GATE_ENABLED" = "true" ] && [ -x "$TEST_SCRIPT" ]; then
+        gates+=(test)
+    fi
+    if [ "$VERIFY_GATE_ENABLED" = "true" ]; then
+        gates+=(verify)
+    fi
+    if [ ${#gates[@]} -lt 2 ]; then
+        return 0
+    fi
+
+    PARALLEL_GATE_DIR=$(mktemp -d)
+
+    local label=$(printf '%s, ' "${gates[@]}")
+    start_build_spinner "Running ${label%, } in parallel..." &
+    BUILD_SPINNER_PID=$!
+
+    cd "$PROJECT_DIR"
+    local gate pids=()
+    for gate in "${gates[@]}"; do
+        (
+            set +e
+            start_time=$(date +%s)
+            case "$gate" in
+                build) run_build ;;
+                test) run_tests ;;
+                verify) "$VERIFY_SCRIPT" ;;
+            esac > "$PARALLEL_GATE_DIR/$gate.log" 2>&1
+            echo "$? $(($(date +%s) - start_time))" > "$PARALLEL_GATE_DIR/$gate.status"
+        ) &
+        pids+=($!)
+    done
+    wait "${pids[@]}" 2>/dev/null || true
+    cd - > /dev/null
+
+    stop_build_spinner
+}
+
+# Use a gate's result from run_gates_in_parallel: copies its output to
+# $2 and sets PARALLEL_EXIT_CODE and PARALLEL_SECONDS. Each result is used once.
+take_parallel_result() {
+    local gate="$1"
+    local log_file="$2"
+    local status_file="$PARALLEL_GATE_DIR/$gate.status"
+
+    if [ -z "$PARALLEL_GATE_DIR" ] || [ ! -f "$status_file" ]; then
+        return 1
+    fi
+
+    read -r PARALLEL_EXIT_CODE PARALLEL_SECONDS < "$status_file"
+    cat "$PARALLEL_GATE_DIR/$gate.log" > "$log_file"
+    rm -f "$status_file"
+    return 0
+}
+
+# Drop unused parallel results, e.g. once a failing gate triggers a fix
+# that makes the other results stale
+discard_parallel_results() {
+    if [ -n "$PARALLEL_GATE_DIR" ]; then
+        rm -rf "$PARALLEL_GATE_DIR"
+        PARALLEL_GATE_DIR=""
+    fi
+}
+
+# Build script path
+BUILD_SCRIPT="$RALPH_CONFIG_DIR/build.sh"
+TEST_SCRIPT="$RALPH_CONFIG_DIR/test.sh"
+
+# Run build script
+run_build() {
+    if [ -x "$BUILD_SCRIPT" ]; then
+        "$BUILD_SCRIPT"
+    else
+        log "${YELLOW}⚠ Build script not found or not executable: $BUILD_SCRIPT${NC}"
+        return 0
+    fi
+}
+
+# Run test script
+# With TEST_CHANGED_ONLY, test.sh gets the files changed since the current task
+# started in RALPH_CHANGED_FILES (empty before the first task: run everything)
+run_tests() {
+    if [ -x "$TEST_SCRIPT" ]; then
+        if [ "$TEST_CHANGED_ONLY" = "true" ]; then
+            RALPH_CHANGED_FILES="$(get_task_changed_files)" "$TEST_SCRIPT"
+        else
+            "$TEST_SCRIPT"
+        fi
+    else
+        log "${YELLOW}⚠ Test script not found or not executable: $TEST_SCRIPT${NC}"
+        return 0
+    fi
+}
+
+verify_build() {
+    if [ "$BUILD_GATE_ENABLED" != "true" ]; then
+        return 0
+    fi
+
+    local build_log=$(mktemp)
+    local start_time=$(date +%s)
+    local build_result
+
+    if take_parallel_result build "$build_log"; then
+        build_result=$PARALLEL_EXIT_CODE
+        start_time=$((start_time - PARALLEL_SECONDS))
+    else
+        # Start spinner in background
+        start_build_spinner "Building..." &
+        BUILD_SPINNER_PID=$!
+
+        cd "$PROJECT_DIR"
+        set +e
+        run_build > "$build_log" 2>&1
+        build_result=$?
+        set -e
+        cd - > /dev/null
+
+        # Stop spinner
+        stop_build_spinner
+    fi
+
+    local elapsed=$(($(date +%s) - start_time))
+
+    if [ $build_result -ne 0 ]; then
+        discard_parallel_results
+        log "${RED}❌ Build failed${NC} (${elapsed}s)"
+        log ""
+        log "${YELLOW}Build output ($(describe_truncation "$BUILD_OUTPUT_LINES")):${NC}"
+        truncate_output "$build_log" "$BUILD_OUTPUT_LINES" | while IFS= read -r line; do
+            log "  $line"
+        done
+        rm -f "$build_log"
+        return 1
+    fi
+
+    log "${GREEN}✓ Build succeeded${NC} (${elapsed}s)"
+    rm -f "$build_log"
+    return 0
+}
+
+#==============================================================================
+# TEST VERIFICATION
+#==============================================================================
+
+# Test gate settings (can be overridden in config.sh)
+TEST_GATE_ENABLED="${TEST_GATE_ENABLED:-true}"
+TEST_FIX_ATTEMPTS="${TEST_FIX_ATTEMPTS:-1}"
+
+verify_tests() {
+    if [ "$TEST_GATE_ENABLED" != "true" ]; then
+        return 0
+    fi
+
+    # Check if test script exists and is executable
+    if [ ! -x "$TEST_SCRIPT" ]; then
+        log "${YELLOW}⚠ No test script found - skipping test verification${NC}"
+        log "${YELLOW}  Create .ralph/test.sh to enable test gates${NC}"
+        return 0
+    fi
+
+    local test_log=$(mktemp)
+    local start_time=$(date +%s)
+    local attempt=0
+    local test_result
+
+    # Flaky suites: only fail if every run fails
+    while true; do
+        if [ $attempt -eq 0 ] && take_parallel_result test "$test_log"; then
+            test_result=$PARALLEL_EXIT_CODE
+            start_time=$((start_time - PARALLEL_SECONDS))
+        else
+            # Start spinner in background
+            start_build_spinner "Running tests..." &
+            BUILD_SPINNER_PID=$!
+
+            cd "$PROJECT_DIR"
+            set +e
+            run_tests > "$test_log" 2>&1
+            test_result=$?
+            set -e
+            cd - > /dev/null
+
+            # Stop spinner
+            stop_build_spinner
+        fi
+
+        if [ $test_result -eq 0 ] || [ $attempt -ge $TEST_FLAKY_RETRIES ]; then
+            break
+        fi
+        attempt=$((attempt + 1))
+        log "${YELLOW}Tests failed - retrying (${attempt}/${TEST_FLAKY_RETRIES})...${NC}"
+    done
+
+    local elapsed=$(($(date +%s) - start_time))
+
+    if [ $test_result -ne 0 ]; then
+        discard_parallel_results
+        log "${RED}❌ Tests failed${NC} (${elapsed}s)"
+        log ""
+        log "${YELLOW}Test output ($(describe_truncation "$TEST_OUTPUT_LINES")):${NC}"
+        truncate_output "$test_log" "$TEST_OUTPUT_LINES" | while IFS= read -r line; do
+            log "  $line"
+        done
+        rm -f "$test_log"
+        return 1
+    fi
+
+    if [ $attempt -gt 0 ]; then
+        log "${GREEN}✓ All tests passed on retry ${attempt}${NC} (${elapsed}s) ${YELLOW}- the test suite may be flaky${NC}"
+    else
+        log "${GREEN}✓ All tests passed${NC} (${elapsed}s)"
+    fi
+    rm -f "$test_log"
+    return 0
+}
+
+TEST_FIX_PROMPT="CRITICAL: Tests are failing and must be fixed before continuing.
+
+Your ONLY task right now is to fix the failing tests. Do not work on any tasks from the task list.
+
+Steps:
+1. Run the test suite to see which tests are failing
+2. Analyze the test failures - understand what's expected vs actual
+3. Determine the root cause. Consider ALL possibilities:
+   - The implementation code may be wrong
+   - The test itself may be wrong (incorrect expectations, outdated assertions)
+   - The test script (.ralph/test.sh) may have issues (timeouts, missing dependencies, incorrect commands)
+   - There may be environment or configuration issues
+4. Fix the issue properly - don't just make tests pass with hacks
+5. Run tests again to verify they pass
+6. If you fix implementation code, make sure the build still passes
+
+Important: If the test script itself is misconfigured (wrong commands, insufficient timeouts, etc.), fix the test script. Check .ralph/test.sh if tests are timing out or failing to run properly.
+
+When all tests pass, output: FIXED
+If you cannot fix the tests, output: ERROR: <description of the problem>
+
+Do NOT output NEXT or DONE - only FIXED or ERROR."
+
+attempt_test_fix() {
+    local fix_log="$LOG_DIR/test_fix_${RUN_ID}_$(date +%H%M%S).log"
+
+    log "${YELLOW}🔧 Attempting to fix failing tests...${NC}"
+    log "   Log: $fix_log"
+
+    if run_agent "$fix_log" "$TEST_FIX_PROMPT" test_fix; then
+        local output=$(cat "$fix_log")
+
+        if output_has_status FIXED "$output"; then
+            log "${GREEN}✓ Test fix reported success${NC}"
+
+            # Verify the fix actually worked
+            if verify_tests; then
+                # Also verify build still passes
+                if verify_build; then
+                    # Commit the fix
+                    if [ "$AUTO_COMMIT" = "true" ]; then
+                        commit_changes "TEST-FIX" "Fix failing tests"
+                    fi
+                    return 0
+                else
+                    log "${RED}❌ Build broken after test fix${NC}"
+                    return 1
+                fi
+            else
+                log "${RED}❌ Tests still failing after fix attempt${NC}"
+                return 1
+            fi
+        elif output_has_status ERROR "$output"; then
+            local error_msg=$(get_status_line ERROR "$output")
+            log "${RED}❌ Test fix failed: $error_msg${NC}"
+            return 1
+        else
+            log "${YELLOW}⚠ No status marker from test fix attempt${NC}"
+            # Check if tests pass anyway
+            if verify_tests; then
+                return 0
+            fi
+            return 1
+        fi
+    else
+        log "${RED}❌ Test fix agent failed${NC}"
+        return 1
+    fi
+}
+
+#==============================================================================
+# CUSTOM VERIFICATION
+#==============================================================================
+# Optional .ralph/verify.sh for projects verified by a single script (e.g.
+# `make ci`). Runs after the build and test gates, or instead of them with
+# VERIFY_MODE="replace".
+
+VERIFY_SCRIPT="$RALPH_CONFIG_DIR/verify.sh"
+VERIFY_GATE_ENABLED=false
+
+if [ -x "$VERIFY_SCRIPT" ]; then
+    VERIFY_GATE_ENABLED=true
+    if [ "$VERIFY_MODE" = "replace" ]; then
+        BUILD_GATE_ENABLED=false
+        TEST_GATE_ENABLED=false
+    fi
+fi
+
+verify_custom() {
+    if [ "$VERIFY_GATE_ENABLED" != "true" ]; then
+        return 0
+    fi
+
+    local verify_log=$(mktemp)
+    local start_time=$(date +%s)
+    local verify_result
+
+    if take_parallel_result verify "$verify_log"; then
+        verify_result=$PARALLEL_EXIT_CODE
+        start_time=$((start_time - PARALLEL_SECONDS))
+    else
+        # Start spinner in background
+        start_build_spinner "Verifying..." &
+        BUILD_SPINNER_PID=$!
+
+        cd "$PROJECT_DIR"
+        set +e
+        "$VERIFY_SCRIPT" > "$verify_log" 2>&1
+        verify_result=$?
+        set -e
+        cd - > /dev/null
+
+        # Stop spinner
+        stop_build_spinner
+    fi
+
+    local elapsed=$(($(date +%s) - start_time))
+
+    if [ $verify_result -ne 0 ]; then
+        discard_parallel_results
+        log "${RED}❌ Verification failed${NC} (${elapsed}s)"
+        log ""
+        log "${YELLOW}Verify output ($(describe_truncation "$TEST_OUTPUT_LINES")):${NC}"
+        truncate_output "$verify_log" "$TEST_OUTPUT_LINES" | while IFS= read -r line; do
+            log "  $line"
+        done
+        rm -f "$verify_log"
+        return 1
+    fi
+
+    log "${GREEN}✓ Verification passed${NC} (${elapsed}s)"
+    rm -f "$verify_log"
+    return 0
+}
+
+VERIFY_FIX_PROMPT="CRITICAL: The project's verification script (.ralph/verify.sh) is failing and must be fixed before continuing.
+
+Your ONLY task right now is to make verification pass. Do not work on any tasks from the task list.
+
+Steps:
+1. Run .ralph/verify.sh to see what fails
+2. Analyze the output - it may include build errors, test failures, lint issues or other checks
+3. Fix the root cause of each failure properly - don't disable checks to make them pass
+4. Run .ralph/verify.sh again to confirm it passes
+
+When verification passes, output: FIXED
+If you cannot fix it, output: ERROR: <description of the problem>
+
+Do NOT output NEXT or DONE - only FIXED or ERROR."
+
+attempt_verify_fix() {
+    local fix_log="$LOG_DIR/verify_fix_${RUN_ID}_$(date +%H%M%S).log"
+
+    log "${YELLOW}🔧 Attempting to fix verification failures...${NC}"
+    log "   Log: $fix_log"
+
+    if run_agent "$fix_log" "$VERIFY_FIX_PROMPT" verify_fix; then
+        local output=$(cat "$fix_log")
+
+        if output_has_status FIXED "$output"; then
+            log "${GREEN}✓ Verify fix reported success${NC}"
+
+            # Verify the fix actually worked
+            if verify_custom; then
+                # Commit the fix
+                if [ "$AUTO_COMMIT" = "true" ]; then
+                    commit_changes "VERIFY-FIX" "Fix verification failures"
+                fi
+                return 0
+            else
+                log "${RED}❌ Verification still failing after fix attempt${NC}"
+                return 1
+            fi
+        elif output_has_status ERROR "$output"; then
+            local error_msg=$(get_status_line ERROR "$output")
+            log "${RED}❌ Verify fix failed: $error_msg${NC}"
+            return 1
+        else
+            log "${YELLOW}⚠ No status marker from verify fix attempt${NC}"
+            # Check if verification passes anyway
+            if verify_custom; then
+                return 0
+            fi
+            return 1
+        fi
+    else
+        log "${RED}❌ Verify fix agent failed${NC}"
+        return 1
+    fi
+}
+
+#==============================================================================
+# PATH SCOPE
+#==============================================================================
+# Tasks with [paths: ...] may only change files matching those globs. "*"
+# also matches "/", so "src/api/*" covers everything under src/api/. The
+# task file itself is always allowed, and untracked files that existed
+# before the task are ignored.
+
+# Files changed by the current task that fall outside its allowed paths
+get_out_of_scope_files() {
+    local task="$1"
+    local allowed_paths=$(get_task_allowed_paths "$task")
+    if [ -z "$allowed_paths" ]; then
+        return 0
+    fi
+
+    local task_file_path="${TASK_FILE#$PROJECT_DIR/}"
+    local file pattern allowed
+    while IFS= read -r file; do
+        if [ -z "$file" ] || [ "$file" = "$task_file_path" ]; then
+            continue
+        fi
+        if echo "$TASK_START_UNTRACKED" | grep -qxF -- "$file"; then
+            continue
+        fi
+        allowed=false
+        while IFS= read -r pattern; do
+            if [[ "$file" == $pattern ]]; then
+                allowed=true
+                break
+            fi
+        done <<< "$allowed_paths"
+        if [ "$allowed" = "false" ]; then
+            echo "$file"
+        fi
+    done <<< "$(get_task_changed_files)"
+}
+
+verify_scope() {
+    local task="$1"
+    local outside=$(get_out_of_scope_files "$task")
+    if [ -z "$outside" ]; then
+        return 0
+    fi
+
+    log "${RED}❌ ${task%%:*} changed files outside its allowed paths${NC}"
+    log "${YELLOW}Allowed:${NC} $(get_task_allowed_paths "$task" | paste -sd ' ' -)"
+    log "${YELLOW}Outside the scope:${NC}"
+    echo "$outside" | while IFS= read -r file; do
+        log "  $file"
+    done
+    return 1
+}
+
+attempt_scope_fix() {
+    local task="$1"
+    local fix_log="$LOG_DIR/scope_fix_${RUN_ID}_$(date +%H%M%S).log"
+    local allowed=$(get_task_allowed_paths "$task" | sed 's/^/- /')
+    local outside=$(get_out_of_scope_files "$task" | sed 's/^/- /')
+    local scope_fix_prompt="CRITICAL: You modified files outside the allowed scope of ${task%%:*}.
+
+This task may only change files matching:
+${allowed}
+
+These changed files are outside that scope:
+${outside}
+
+Your ONLY task right now is to undo the changes to those files (git checkout or delete new files),
+moving any work that belongs to this task into the allowed paths. Do not touch other tasks.
+
+When only allowed files are changed, output: FIXED
+If you cannot do that, output: ERROR: <description of the problem>
+
+Do NOT output NEXT or DONE - only FIXED or ERROR."
+
+    log "${YELLOW}🔧 Asking the agent to revert out-of-scope changes...${NC}"
+    log "   Log: $fix_log"
+
+    if run_agent "$fix_log" "$scope_fix_prompt" scope_fix; then
+        local output=$(cat "$fix_log")
+        if output_has_status ERROR "$output"; then
+            local error_msg=$(get_status_line ERROR "$output")
+            log "${RED}❌ Scope fix failed: $error_msg${NC}"
+            return 1
+        fi
+        if verify_scope "$task"; then
+            log "${GREEN}✓ Changes are back within the allowed paths${NC}"
+            return 0
+        fi
+        log "${RED}❌ Files are still changed outside the allowed paths${NC}"
+        return 1
+    else
+        log "${RED}❌ Scope fix agent failed${NC}"
+        return 1
+    fi
+}
+
+#==============================================================================
+# REVIEW MODE
+#==============================================================================
+
+REVIEW_PROMPT="You are a code reviewer. Your job is to review recent changes and ensure quality.
+
+## Your Task
+
+Review the last few commits and check for:
+
+### 1. Code Quality
+- Is the code clean and readable?
+- Are there any TODO comments that should be resolved?
+- Is there dead code, unused imports, or commented-out code?
+- Is error handling appropriate?
+
+### 2. Consistency
+- Do the changes follow existing patterns in the codebase?
+- Is naming consistent with the rest of the project?
+- Does the code style match the project conventions?
+
+### 3. Completeness
+- Are there any incomplete implementations?
+- Are edge cases handled?
+- Is there appropriate test coverage?
+
+### 4. Documentation
+- Are public APIs documented?
+- Are complex algorithms explained?
+
+## What to Do
+
+1. Run: git log --oneline -5 to see recent commits
+2. Run: git diff HEAD~3 to see recent changes (adjust number as needed)
+3. Review the changes against the criteria above
+4. Fix any issues you find
+5. Run build and tests to verify your fixes
+
+## Output
+
+When review is complete:
+- If you made fixes: output FIXED
+- If no issues found: output CLEAN
+- If you found issues you cannot fix: output ERROR: <description>
+
+Do NOT output NEXT or DONE."
+
+run_review() {
+    if [ "$REVIEW_MODE_ENABLED" != "true" ]; then
+        return 0
+    fi
+
+    local review_log="$LOG_DIR/review_${RUN_ID}_$(date +%H%M%S).log"
+
+    log "${CYAN}🔍 Running code review...${NC}"
+    log "   Log: $review_log"
+
+    if run_agent "$review_log" "$REVIEW_PROMPT" review; then
+        local output=$(cat "$review_log")
+
+        if output_has_status FIXED "$output"; then
+            log "${GREEN}✓ Review found and fixed issues${NC}"
+
+            # Verify build and tests still pass
+            if verify_build && verify_tests; then
+                if [ "$AUTO_COMMIT" = "true" ]; then
+                    commit_changes "REVIEW" "Code review cleanup"
+                fi
+                return 0
+            else
+                log "${RED}❌ Build or tests broken after review fixes${NC}"
+                return 1
+            fi
+        elif output_has_status CLEAN "$output"; then
+            log "${GREEN}✓ Review passed - no issues found${NC}"
+            return 0
+        elif output_has_status ERROR "$output"; then
+            local error_msg=$(get_status_line ERROR "$output")
+            log "${YELLOW}⚠ Review found issues: $error_msg${NC}"
+            # Don't fail the run, just log the warning
+            return 0
+        else
+            log "${YELLOW}⚠ No status marker from review${NC}"
+            return 0
+        fi
+    else
+        log "${YELLOW}⚠ Review agent failed - continuing anyway${NC}"
+        return 0
+    fi
+}
+
+#==============================================================================
+# BUILD FIX MODE
+#==============================================================================
+
+BUILD_FIX_PROMPT="CRITICAL: The build is broken and must be fixed before any other work.
+
+Your ONLY task right now is to fix the build. Do not work on any tasks from the task list.
+
+Steps:
+1. Run the build command to see the errors
+2. Analyze the error messages
+3. Fix the issues causing the build to fail
+4. Verify the build succeeds
+5. If tests are required, run them too
+
+When the build is fixed and passing, output: FIXED
+If you cannot fix the build, output: ERROR: <description of the problem>
+
+Do NOT output NEXT or DONE - only FIXED or ERROR."
+
+attempt_build_fix() {
+    local fix_log="$LOG_DIR/build_fix_${RUN_ID}_$(date +%H%M%S).log"
+
+    log "${YELLOW}🔧 Attempting to fix build...${NC}"
+    log "   Log: $fix_log"
+
+    if run_agent "$fix_log" "$BUILD_FIX_PROMPT" build_fix; then
+        local output=$(cat "$fix_log")
+
+        if output_has_status FIXED "$output"; then
+            log "${GREEN}✓ Build fix reported success${NC}"
+
+            # Verify the fix actually worked
+            if verify_build; then
+                # Commit the fix
+                if [ "$AUTO_COMMIT" = "true" ]; then
+                    commit_changes "BUILD-FIX" "Fix broken build"
+                fi
+                return 0
+            else
+                log "${RED}❌ Build still failing after fix attempt${NC}"
+                return 1
+            fi
+        elif output_has_status ERROR "$output"; then
+            local error_msg=$(get_status_line ERROR "$output")
+            log "${RED}❌ Build fix failed: $error_msg${NC}"
+            return 1
+        else
+            log "${YELLOW}⚠ No status marker from build fix attempt${NC}"
+            # Check if build works anyway
+            if verify_build; then
+                return 0
+            fi
+            return 1
+        fi
+    else
+        log "${RED}❌ Build fix agent failed${NC}"
+        return 1
+    fi
+}
+
+# Why the loop stopped early, for the run report
+STOP_REASON=""
+
+# Stop the run with a banner, roll back the current task's changes and exit.
+# Extra arguments are logged under the message. A more specific STOP_REASON
+# set beforehand (e.g. by run_fix_attempts) is kept for the report.
+stop_run() {
+    local message="$1"
+    shift
+
+    STOP_REASON="${STOP_REASON:-$message}"
+    log "${RED}═══════════════════════════════════════════════════════════════${NC}"
+    log "${RED}STOPPING: ${message}${NC}"
+    local line
+    for line in "$@"; do
+        log "${RED}${line}${NC}"
+    done
+    log "${RED}═══════════════════════════════════════════════════════════════${NC}"
+    rollback_task
+    exit 1
+}
+
+# Run a gate's fix up to its attempt limit: the task's [fix-attempts: N],
+# otherwise BUILD_FIX_ATTEMPTS or TEST_FIX_ATTEMPTS (verify.sh uses the
+# test limit). These are separate from MAX_CONSECUTIVE_FAILURES, which
+# counts iterations where the agent didn't finish the task at all.
+run_fix_attempts() {
+    local gate="$1"
+    local task="$2"
+    local max_attempts=$(get_task_fix_attempts "$task")
+    local label="Build"
+
+    case "$gate" in
+        build)
+            max_attempts="${max_attempts:-$BUILD_FIX_ATTEMPTS}"
+            ;;
+        test)
+            max_attempts="${max_attempts:-$TEST_FIX_ATTEMPTS}"
+            label="Tests"
+            ;;
+        verify)
+            max_attempts="${max_attempts:-$TEST_FIX_ATTEMPTS}"
+            label="Verification"
+            ;;
+    esac
+
+    local attempt
+    for ((attempt = 1; attempt <= max_attempts; attempt++)); do
+        if [ "$max_attempts" -gt 1 ]; then
+            log "${YELLOW}Fix attempt ${attempt}/${max_attempts}${NC}"
+        fi
+        if "attempt_${gate}_fix"; then
+            return 0
+        fi
+    done
+
+    if [ "$max_attempts" -eq 0 ]; then
+        STOP_REASON="${label} failing and fix attempts are disabled"
+    else
+        STOP_REASON="${label} still failing after ${max_attempts} fix attempt(s)"
+    fi
+    if [ -n "$task" ]; then
+        STOP_REASON+=" (${task%%:*})"
+    fi
+    log "${RED}❌ ${STOP_REASON}${NC}"
+    return 1
+}
+
+# Checks after the agent finishes a task: its allowed paths, then the build,
+# test and verify gates, fixing failures up to the attempt limits. Stops the
+# run if any of them can't be fixed. [skip-verify] tasks skip the gates.
+run_post_task_gates() {
+    local task="$1"
+    local skip_verify=false
+    if task_skips_verify "$task"; then
+        skip_verify=true
+        log "${CYAN}⏭  Skipping verification for ${task%%:*} ([skip-verify])${NC}"
+    fi
+
+    # Only the task's allowed paths may change ([paths: ...])
+    if ! verify_scope "$task"; then
+        if ! attempt_scope_fix "$task"; then
+            stop_run "Files changed outside ${task%%:*}'s allowed paths"
+        fi
+    fi
+
+    if [ "$VERIFY_PARALLEL" = "true" ] && [ "$skip_verify" = "false" ]; then
+        run_gates_in_parallel
+    fi
+
+    if [ "$BUILD_GATE_ENABLED" = "true" ] && [ "$skip_verify" = "false" ]; then
+        if ! verify_build; then
+            log "${YELLOW}Build broken after task - attempting fix...${NC}"
+            if ! run_fix_attempts build "$task"; then
+                set_last_iteration_status "Build unfixable"
+                stop_run "Build broken and could not be fixed"
+            fi
+        fi
+    fi
+
+    if [ "$TEST_GATE_ENABLED" = "true" ] && [ "$skip_verify" = "false" ]; then
+        if ! verify_tests; then
+            log "${YELLOW}Tests failing after task - attempting fix...${NC}"
+            if ! run_fix_attempts test "$task"; then
+                set_last_iteration_status "Tests unfixable"
+                stop_run "Tests failing and could not be fixed"
+            fi
         fi
     fi
 
-    # Level 3: Project-specific instructions (skip if placeholder)
-    if [ -f "$project_prompt_file" ]; then
-        if is_placeholder_file "$project_prompt_file"; then
-            log "${YELLOW}Note: project_prompt.txt contains placeholder content - skipping${NC}"
-        else
-            echo "# Level 3: Project-Specific Instructions"
-            echo ""
-            cat "$project_prompt_file"
+    if [ "$VERIFY_GATE_ENABLED" = "true" ] && [ "$skip_verify" = "false" ]; then
+        if ! verify_custom; then
+            log "${YELLOW}Verification failing after task - attempting fix...${NC}"
+            if ! run_fix_attempts verify "$task"; then
+                set_last_iteration_status "Verification unfixable"
+                stop_run "Verification failing and could not be fixed"
+            fi
         fi
     fi
+
+    discard_parallel_results
 }
 
 #==============================================================================
-# AGENT COMMANDS
+# GIT OPERATIONS
 #==============================================================================
 
-# Progress monitor - runs in background to show activity
-# Uses ANSI escape codes to update multiple lines in place
-start_progress_monitor() {
-    local log_file="$1"
-    local start_time=$(date +%s)
-    local spinner_chars='⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏'
-    local spinner_idx=0
+# With COMMIT_EACH_ITERATION, the commit before the current task's first WIP
+# commit, so the completion commit can squash them
+WIP_BASE=""
+WIP_TASK=""
 
-    # Hide cursor
-    printf "\033[?25l"
+# git commit as COMMIT_AUTHOR_NAME/EMAIL, with the COMMIT_CO_AUTHOR trailer.
+# Extra arguments (e.g. -q) are passed to git commit.
+ralph_git_commit() {
+    local message="$1"
+    shift
 
-    while true; do
-        sleep 1
+    local identity=()
+    if [ -n "$COMMIT_AUTHOR_NAME" ]; then
+        identity+=(-c "user.name=$COMMIT_AUTHOR_NAME")
+    fi
+    if [ -n "$COMMIT_AUTHOR_EMAIL" ]; then
+        identity+=(-c "user.email=$COMMIT_AUTHOR_EMAIL")
+    fi
 
-        local elapsed=$(($(date +%s) - start_time))
-        local mins=$((elapsed / 60))
-        local secs=$((elapsed % 60))
+    if [ -n "$COMMIT_CO_AUTHOR" ]; then
+        message+=$'\n\n'"Co-authored-by: $(expand_env_value "$COMMIT_CO_AUTHOR")"
+    fi
 
-        # Count modified files
-        local changed_files=$(git status --porcelain 2>/dev/null | wc -l | tr -d ' ')
+    git "${identity[@]}" commit "$@" -m "$message"
+}
 
-        # Get last meaningful line from log (skip empty lines)
-        local last_line=""
-        if [ -f "$log_file" ]; then
-            last_line=$(tail -20 "$log_file" 2>/dev/null | grep -v '^$' | tail -1 | head -c 60)
-        fi
+# Stage changes for a commit according to COMMIT_STAGE_MODE. In "task" mode
+# only files changed since the task started are staged; files that were
+# already dirty then are left out unless the task changed them further.
+stage_changes() {
+    case "$COMMIT_STAGE_MODE" in
+        tracked)
+            git add -u
+            ;;
+        task)
+            local file
+            while IFS= read -r file; do
+                if [ -z "$file" ] || task_left_file_unchanged "$file"; then
+                    continue
+                fi
+                git add -A -- "$file"
+            done <<< "$(get_task_changed_files)"
+            ;;
+        *)
+            git add -A
+            ;;
+    esac
+}
 
-        # Spinner animation
-        local spinner="${spinner_chars:$spinner_idx:1}"
-        spinner_idx=$(( (spinner_idx + 1) % ${#spinner_chars} ))
+# Commit an unfinished iteration's changes as "wip: TASK-ID iteration N"
+commit_wip() {
+    local task_id="$1"
+    local iteration="$2"
 
-        # Move cursor up 3 lines, clear them, and redraw
-        # (On first iteration, these lines don't exist yet, but that's OK)
-        printf "\033[3A\033[J"
+    if [ "$AUTO_COMMIT" != "true" ] || [ "$COMMIT_EACH_ITERATION" != "true" ]; then
+        return 0
+    fi
 
-        # Line 1: Status with spinner
-        printf "${CYAN}%s Agent working...${NC}\n" "$spinner"
+    cd "$PROJECT_DIR"
 
-        # Line 2: Stats
-        printf "  ${YELLOW}⏱${NC}  %02d:%02d elapsed  ${YELLOW}📁${NC}  %d files changed\n" "$mins" "$secs" "$changed_files"
+    if [ -z "$(git status --porcelain 2>/dev/null)" ]; then
+        cd - > /dev/null
+        return 0
+    fi
 
-        # Line 3: Last output (truncated) or status message
-        if [ -n "$last_line" ]; then
-            printf "  ${YELLOW}💬${NC}  %.60s\n" "$last_line"
-        else
-            # No output yet - agent is initializing or thinking
-            local thinking_msgs=("Agent is thinking..." "Processing request..." "Analyzing codebase..." "Preparing response...")
-            local msg_idx=$(( (elapsed / 5) % 4 ))
-            printf "  ${YELLOW}💬${NC}  ${thinking_msgs[$msg_idx]}\n"
+    if [ "$WIP_TASK" != "$task_id" ]; then
+        WIP_BASE=$(git rev-parse -q --verify HEAD 2>/dev/null || true)
+        WIP_TASK="$task_id"
+    fi
+
+    stage_changes
+    if git diff --cached --quiet; then
+        cd - > /dev/null
+        return 0
+    fi
+
+    local commit_msg="wip: ${task_id} iteration ${iteration}"
+    if ralph_git_commit "$commit_msg" -q 2>&1; then
+        log "${GREEN}✓ Committed: ${commit_msg}${NC}"
+    else
+        log "${YELLOW}⚠ Git commit returned non-zero${NC}"
+    fi
+
+    cd - > /dev/null
+}
+
+# Files changed, insertions and deletions of each task's commit, as
+# "<task id><tab><files><tab><insertions><tab><deletions>"
+TASK_DIFF_STATS=()
+
+record_task_diff_stat() {
+    TASK_DIFF_STATS+=("$1"$'\t'"$2"$'\t'"$3"$'\t'"$4")
+}
+
+# Tab-separated files, insertions and deletions for a task (the latest
+# commit if there were several), or nothing if it wasn't committed
+get_task_diff_stat() {
+    local entry stat=""
+    for entry in "${TASK_DIFF_STATS[@]}"; do
+        if [ "${entry%%$'\t'*}" = "$1" ]; then
+            stat="${entry#*$'\t'}"
         fi
     done
+    echo "$stat"
 }
 
-stop_progress_monitor() {
-    if [ -n "$PROGRESS_PID" ] && kill -0 "$PROGRESS_PID" 2>/dev/null; then
-        kill "$PROGRESS_PID" 2>/dev/null
-        wait "$PROGRESS_PID" 2>/dev/null
+# "3 files changed, +42 -7" (or "No changes") from files, insertions, deletions
+format_diff_stat() {
+    if [ "$1" -eq 0 ]; then
+        echo "No changes"
+    elif [ "$1" -eq 1 ]; then
+        echo "1 file changed, +$2 -$3"
+    else
+        echo "$1 files changed, +$2 -$3"
     fi
-    # Show cursor again
-    printf "\033[?25h"
-    # Clear the progress lines
-    printf "\033[3A\033[J"
 }
 
-# Show summary after agent completes
-show_agent_summary() {
-    local log_file="$1"
-    local start_time="$2"
-    local end_time=$(date +%s)
-    local elapsed=$((end_time - start_time))
-    local mins=$((elapsed / 60))
-    local secs=$((elapsed % 60))
-
-    # Count changes
-    local changed_files=$(git status --porcelain 2>/dev/null | wc -l | tr -d ' ')
-    local lines_in_log=$(wc -l < "$log_file" 2>/dev/null | tr -d ' ')
+commit_changes() {
+    local task_id="$1"
+    local task_desc="$2"
 
-    echo -e "${GREEN}✓ Agent completed in ${mins}m ${secs}s${NC}"
-    echo -e "  Files changed: $changed_files | Log lines: $lines_in_log"
-}
+    if [ "$AUTO_COMMIT" != "true" ]; then
+        return 0
+    fi
 
-# Default agent commands - can be overridden in config.sh
-run_agent_cursor() {
-    local prompt="$1"
-    local log_file="$2"
-    local start_time=$(date +%s)
+    cd "$PROJECT_DIR"
 
-    if ! command -v agent &> /dev/null; then
-        log "${RED}ERROR: 'agent' command not found. Please install Cursor CLI.${NC}"
-        return 1
+    # Fold this task's WIP commits back into the working tree so they end up
+    # in the completion commit
+    if [ -n "$WIP_BASE" ]; then
+        if [ "$SQUASH_WIP_COMMITS" = "true" ] && [ "$WIP_TASK" = "$task_id" ]; then
+            git reset -q --soft "$WIP_BASE"
+            log "${CYAN}Squashing WIP commits for ${task_id}${NC}"
+        fi
+        WIP_BASE=""
+        WIP_TASK=""
     fi
 
-    # Print 3 blank lines for the progress monitor to use
-    echo ""
-    echo ""
-    echo ""
+    # Check for uncommitted changes
+    if git diff --quiet HEAD 2>/dev/null && git diff --cached --quiet 2>/dev/null; then
+        if [ -z "$(git ls-files --others --exclude-standard)" ]; then
+            log "${YELLOW}No changes to commit${NC}"
+            record_task_diff_stat "$task_id" 0 0 0
+            cd - > /dev/null
+            return 0
+        fi
+    fi
 
-    # Start progress monitor in background
-    start_progress_monitor "$log_file" &
-    PROGRESS_PID=$!
+    stage_changes
+    if git diff --cached --quiet; then
+        log "${YELLOW}No changes to commit (COMMIT_STAGE_MODE=${COMMIT_STAGE_MODE})${NC}"
+        record_task_diff_stat "$task_id" 0 0 0
+        cd - > /dev/null
+        return 0
+    fi
 
-    # Run agent, output goes to log file only (progress monitor shows status)
-    # --force allows agents to run shell commands within their tasks
-    if [ -n "$SELECTED_MODEL" ]; then
-        echo "$prompt" | agent --print --force --model "$SELECTED_MODEL" > "$log_file" 2>&1
+    # Build commit message
+    local commit_msg
+    if [ -n "$COMMIT_SCOPE" ]; then
+        commit_msg="${COMMIT_PREFIX}(${COMMIT_SCOPE}): ${task_id} - ${task_desc}"
     else
-        echo "$prompt" | agent --print --force > "$log_file" 2>&1
+        commit_msg="${COMMIT_PREFIX}: ${task_id} - ${task_desc}"
     fi
-    local exit_code=$?
 
-    # Stop progress monitor and show summary
-    stop_progress_monitor
-    show_agent_summary "$log_file" "$start_time"
+    if ralph_git_commit "$commit_msg" 2>&1; then
+        log "${GREEN}✓ Committed: ${commit_msg}${NC}"
 
-    return $exit_code
+        # Binary files count as changed, without line counts
+        local files insertions deletions
+        IFS=$'\t' read -r files insertions deletions <<< "$(git show --numstat --format= HEAD | awk '
+            NF { files++; if ($1 != "-") ins += $1; if ($2 != "-") del += $2 }
+            END { printf "%d\t%d\t%d\n", files, ins, del }
+        ')"
+        record_task_diff_stat "$task_id" "$files" "$insertions" "$deletions"
+        log "   $(format_diff_stat "$files" "$insertions" "$deletions")"
+    else
+        log "${YELLOW}⚠ Git commit returned non-zero${NC}"
+    fi
+
+    cd - > /dev/null
 }
 
-run_agent_auggie() {
-    local prompt="$1"
-    local log_file="$2"
-    local start_time=$(date +%s)
+# The state of the tree when the current task started, for ROLLBACK_ON_FAILURE
+# and TEST_CHANGED_ONLY
+TASK_START_TASK=""
+TASK_START_HEAD=""
+TASK_START_UNTRACKED=""
+TASK_START_DIRTY=""  # "<blob hash> <path>" for files already changed when the task started
+TASK_START_CLEAN=false
 
-    if ! command -v auggie &> /dev/null; then
-        log "${RED}ERROR: 'auggie' command not found. Please install Augment CLI.${NC}"
-        return 1
-    fi
+# Snapshot the tree the first time a task is attempted
+snapshot_task_start() {
+    local task="$1"
 
-    # Print 3 blank lines for the progress monitor to use
-    echo ""
-    echo ""
-    echo ""
+    if [ "$task" = "$TASK_START_TASK" ]; then
+        return 0
+    fi
 
-    # Start progress monitor in background
-    start_progress_monitor "$log_file" &
-    PROGRESS_PID=$!
+    # The run's own logs change constantly and are never rolled back
+    local logs_path="${LOG_DIR#$PROJECT_DIR/}"
 
-    # Run agent, output goes to log file only
-    if [ -n "$SELECTED_MODEL" ] && [ "$SELECTED_MODEL" != "default" ]; then
-        auggie --print --quiet --model "$SELECTED_MODEL" "$prompt" > "$log_file" 2>&1
+    cd "$PROJECT_DIR"
+    TASK_START_TASK="$task"
+    # Empty in a repository with no commits yet
+    TASK_START_HEAD=$(git rev-parse -q --verify HEAD 2>/dev/null || true)
+    TASK_START_UNTRACKED=$(git ls-files --others --exclude-standard)
+    TASK_START_DIRTY=$({
+        if [ -n "$TASK_START_HEAD" ]; then
+            git diff --name-only HEAD
+        else
+            git ls-files
+        fi
+        echo "$TASK_START_UNTRACKED"
+    } | sort -u | while IFS= read -r file; do
+        if [ -n "$file" ] && [ -f "$file" ]; then
+            echo "$(git hash-object -- "$file") $file"
+        fi
+    done)
+    if [ -z "$(git status --porcelain --untracked-files=no -- . ":(exclude)$logs_path")" ]; then
+        TASK_START_CLEAN=true
     else
-        auggie --print --quiet "$prompt" > "$log_file" 2>&1
+        TASK_START_CLEAN=false
     fi
-    local exit_code=$?
+    cd - > /dev/null
+}
 
-    # Stop progress monitor and show summary
-    stop_progress_monitor
-    show_agent_summary "$log_file" "$start_time"
+# Files changed since the current task started (committed or not), one per line
+get_task_changed_files() {
+    if [ -z "$TASK_START_TASK" ]; then
+        return 0
+    fi
 
-    return $exit_code
+    local logs_path="${LOG_DIR#$PROJECT_DIR/}"
+
+    cd "$PROJECT_DIR"
+    {
+        # Without a starting commit, every file is new
+        if [ -n "$TASK_START_HEAD" ]; then
+            git diff --name-only "$TASK_START_HEAD"
+        else
+            git ls-files
+        fi
+        git ls-files --others --exclude-standard
+    } | grep -v "^$logs_path/" | sort -u || true
+    cd - > /dev/null
 }
 
-run_agent() {
-    local log_file="$1"
-    local prompt_override="$2"  # Optional: for build fix prompts
+# True if a file was already changed when the task started and still has
+# the same contents
+task_left_file_unchanged() {
+    local file="$1"
+    local entry=$(echo "$TASK_START_DIRTY" | grep -F -- " $file" | awk -v f="$file" 'substr($0, index($0, " ") + 1) == f' | head -1)
+    if [ -z "$entry" ] || [ ! -f "$file" ]; then
+        return 1
+    fi
+    [ "${entry%% *}" = "$(git hash-object -- "$file")" ]
+}
 
-    local prompt
-    if [ -n "$prompt_override" ]; then
-        prompt="$prompt_override"
-    else
-        prompt=$(build_prompt)
+# Reset the tree to the current task's snapshot. Commits from earlier tasks
+# are never touched, and only untracked files the task created are removed.
+rollback_task() {
+    if [ "$ROLLBACK_ON_FAILURE" != "true" ] || [ -z "$TASK_START_TASK" ]; then
+        return 0
+    fi
+
+    if [ -z "$TASK_START_HEAD" ]; then
+        log "${YELLOW}⚠ Not rolling back: the repository had no commits when ${TASK_START_TASK%%:*} started${NC}"
+        return 0
+    fi
+
+    if [ "$TASK_START_CLEAN" != "true" ]; then
+        log "${YELLOW}⚠ Not rolling back: there were uncommitted changes before ${TASK_START_TASK%%:*} started${NC}"
+        return 0
     fi
 
+    local logs_path="${LOG_DIR#$PROJECT_DIR/}"
+
     cd "$PROJECT_DIR"
+    git reset -q "$TASK_START_HEAD"
+    git checkout -q "$TASK_START_HEAD" -- . ":(exclude)$logs_path"
+    git ls-files --others --exclude-standard | while IFS= read -r file; do
+        case "$file" in
+            "$logs_path"/*) continue ;;
+        esac
+        if ! echo "$TASK_START_UNTRACKED" | grep -qxF -- "$file"; then
+            rm -f "$file"
+        fi
+    done
+    log "${YELLOW}↩ Rolled back changes from ${TASK_START_TASK%%:*} to $(git rev-parse --short HEAD)${NC}"
+    cd - > /dev/null
+}
 
-    set +e  # Temporarily disable exit on error
+#==============================================================================
+# CONFIG RELOAD
+#==============================================================================
+# With --watch-config, config changes are picked up between tasks.
+# The agent and model stay as they were at startup; an invalid config is
+# ignored and the last good values are kept.
 
-    case "$AGENT_TYPE" in
-        cursor)
-            run_agent_cursor "$prompt" "$log_file"
-            ;;
-        auggie)
-            run_agent_auggie "$prompt" "$log_file"
-            ;;
-        custom)
-            # Custom agent command should be defined in config.sh as run_agent_custom()
-            if type run_agent_custom &> /dev/null; then
-                run_agent_custom "$prompt" "$log_file"
-            else
-                log "${RED}ERROR: Custom agent selected but run_agent_custom() not defined in config.sh${NC}"
-                set -e
-                return 1
-            fi
-            ;;
-        *)
-            log "${RED}ERROR: Unknown agent type '$AGENT_TYPE'. Use 'cursor', 'auggie', or 'custom'.${NC}"
-            set -e
-            return 1
-            ;;
-    esac
+CONFIG_SIGNATURE=""
 
-    local agent_exit=$?
-    set -e
+config_signature() {
+    cat "${USER_CONFIG_FILE:-/dev/null}" "$CONFIG_FILE" "${EXTENDS_FILE:-/dev/null}" "${PROFILE_FILE:-/dev/null}" 2>/dev/null | cksum
+}
 
-    cd - > /dev/null
-    return 0  # We check log content, not exit code
+# Same layering as at startup: user config, base config, config.sh, then the profile
+source_config_files() {
+    if [ -n "$USER_CONFIG_FILE" ]; then
+        source "$USER_CONFIG_FILE"
+        unset CONFIG_EXTENDS
+    fi
+    source "$CONFIG_FILE"
+    if [ -n "$EXTENDS_FILE" ]; then
+        source "$EXTENDS_FILE"
+        source "$CONFIG_FILE"
+    fi
+    if [ -n "$PROFILE_FILE" ]; then
+        source "$PROFILE_FILE"
+    fi
 }
 
-#==============================================================================
-# TASK COUNTING
-#==============================================================================
+reload_config_if_changed() {
+    local signature=$(config_signature)
+    if [ "$signature" = "$CONFIG_SIGNATURE" ]; then
+        return 0
+    fi
+    CONFIG_SIGNATURE="$signature"
 
-count_remaining() {
-    grep -c "^\- \[ \]" "$TASK_FILE" 2>/dev/null || echo "0"
-}
+    log "${CYAN}Config changed - reloading...${NC}"
 
-count_completed() {
-    grep -c "^\- \[x\]" "$TASK_FILE" 2>/dev/null || echo "0"
-}
+    local file
+    for file in "$USER_CONFIG_FILE" "$CONFIG_FILE" "$EXTENDS_FILE" "$PROFILE_FILE"; do
+        if [ -n "$file" ] && ! bash -n "$file" 2>/dev/null; then
+            log "${YELLOW}⚠ Ignoring config change: syntax error in $file${NC}"
+            return 0
+        fi
+    done
 
-get_next_task() {
-    grep "^\- \[ \]" "$TASK_FILE" | head -1 | sed -E 's/- \[ \] //'
-}
+    local config_errors
+    if ! config_errors=$(source_config_files && validate_config_values); then
+        log "${YELLOW}⚠ Ignoring config change: invalid values${NC}"
+        local line
+        while IFS= read -r line; do
+            log "    $line"
+        done <<< "$config_errors"
+        return 0
+    fi
 
-get_last_completed_task_id() {
-    grep "^\- \[x\]" "$TASK_FILE" | tail -1 | sed -E 's/.*\[x\] ([A-Za-z0-9_-]+):.*/\1/'
-}
+    local running_agent="$AGENT_TYPE"
+    source_config_files
+
+    local configured_agent="${AGENT_OVERRIDE:-${AGENT_TYPE:-$DEFAULT_AGENT}}"
+    if [ "$configured_agent" != "$running_agent" ]; then
+        log "${YELLOW}⚠ AGENT_TYPE change ignored until restart (still using ${running_agent})${NC}"
+    fi
+    AGENT_TYPE="$running_agent"
+
+    # Re-apply settings derived from config at startup
+    if [ "$VERIFY_GATE_ENABLED" = "true" ] && [ "$VERIFY_MODE" = "replace" ]; then
+        BUILD_GATE_ENABLED=false
+        TEST_GATE_ENABLED=false
+    fi
+    build_redact_script
 
-get_last_completed_task_description() {
-    grep "^\- \[x\]" "$TASK_FILE" | tail -1 | sed -E 's/.*\[x\] [A-Za-z0-9_-]+: (.*)/\1/'
+    log "${GREEN}✓ Config reloaded${NC}"
 }
 
 #==============================================================================
-# BUILD VERIFICATION
+# RUN REPORT
 #==============================================================================
+# A markdown summary of the run (suitable for attaching to a PR), written to
+# logs/report_<run id>.md when the loop exits, including on failure.
 
-# Build/test progress spinner - runs in background
-BUILD_SPINNER_PID=""
-
-start_build_spinner() {
-    local label="$1"
-    local spinner_chars='⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏'
-    local spinner_idx=0
-    local start_time=$(date +%s)
+# One tab-separated row per iteration:
+# iteration, task, status, duration, log, model, start and end (epoch seconds)
+REPORT_ROWS=()
+RUN_START_TIME=""
+RUN_START_HEAD=""
 
-    # Hide cursor
-    printf "\033[?25l"
+record_iteration() {
+    REPORT_ROWS+=("$1"$'\t'"$2"$'\t'"$3"$'\t'"$4"$'\t'"$5"$'\t'"${SELECTED_MODEL:-default}"$'\t'"$6"$'\t'"$7")
+}
 
-    while true; do
-        sleep 0.5
-        local elapsed=$(($(date +%s) - start_time))
-        local mins=$((elapsed / 60))
-        local secs=$((elapsed % 60))
+# Change the status of the latest iteration, e.g. when the agent finished a
+# task but its build couldn't be fixed afterwards
+set_last_iteration_status() {
+    local last=$((${#REPORT_ROWS[@]} - 1))
+    if [ "$last" -lt 0 ]; then
+        return 0
+    fi
+    local iter task status rest
+    IFS=$'\t' read -r iter task status rest <<< "${REPORT_ROWS[$last]}"
+    REPORT_ROWS[$last]="$iter"$'\t'"$task"$'\t'"$1"$'\t'"$rest"
+}
 
-        local spinner="${spinner_chars:$spinner_idx:1}"
-        spinner_idx=$(( (spinner_idx + 1) % ${#spinner_chars} ))
+# Whether an iteration status counts as a failed iteration in summaries
+iteration_status_is_failure() {
+    case "$1" in
+        Error|"Agent failed"|"Not authenticated"|*unfixable) return 0 ;;
+        *) return 1 ;;
+    esac
+}
 
-        # Clear line and show spinner with elapsed time
-        printf "\r\033[K${CYAN}%s %s${NC} %02d:%02d" "$spinner" "$label" "$mins" "$secs"
+# Completed and failed iterations recorded so far, as "<completed> <failed>"
+count_iteration_results() {
+    local completed=0 failed=0 row iter task status
+    for row in "${REPORT_ROWS[@]}"; do
+        IFS=$'\t' read -r iter task status _ <<< "$row"
+        if [ "$status" = "Completed" ]; then
+            completed=$((completed + 1))
+        elif iteration_status_is_failure "$status"; then
+            failed=$((failed + 1))
+        fi
     done
+    echo "$completed $failed"
 }
 
-stop_build_spinner() {
-    if [ -n "$BUILD_SPINNER_PID" ] && kill -0 "$BUILD_SPINNER_PID" 2>/dev/null; then
-        kill "$BUILD_SPINNER_PID" 2>/dev/null
-        wait "$BUILD_SPINNER_PID" 2>/dev/null
+# Per-task totals from REPORT_ROWS, in the order tasks were first worked on.
+# Tab-separated: task id, iterations, seconds, start, end, last status
+summarize_task_times() {
+    if [ ${#REPORT_ROWS[@]} -eq 0 ]; then
+        return 0
     fi
-    BUILD_SPINNER_PID=""
-    # Show cursor and clear line
-    printf "\033[?25h\r\033[K"
+    printf '%s\n' "${REPORT_ROWS[@]}" | awk -F'\t' '
+        {
+            id = $2; sub(/:.*/, "", id)
+            if (!(id in iterations)) { order[++n] = id; start[id] = $7 }
+            iterations[id]++
+            seconds[id] += $8 - $7
+            end[id] = $8
+            status[id] = $3
+        }
+        END {
+            for (i = 1; i <= n; i++) {
+                id = order[i]
+                printf "%s\t%d\t%d\t%s\t%s\t%s\n", id, iterations[id], seconds[id], start[id], end[id], status[id]
+            }
+        }
+    '
 }
 
-# Build script path
-BUILD_SCRIPT="$RALPH_CONFIG_DIR/build.sh"
-TEST_SCRIPT="$RALPH_CONFIG_DIR/test.sh"
+# Format epoch seconds as an ISO 8601 UTC timestamp (GNU and BSD date)
+format_timestamp() {
+    date -u -d "@$1" +"%Y-%m-%dT%H:%M:%SZ" 2>/dev/null || date -u -r "$1" +"%Y-%m-%dT%H:%M:%SZ"
+}
 
-# Run build script
-run_build() {
-    if [ -x "$BUILD_SCRIPT" ]; then
-        "$BUILD_SCRIPT"
-    else
-        log "${YELLOW}⚠ Build script not found or not executable: $BUILD_SCRIPT${NC}"
-        return 0
+# Machine-readable per-task metrics next to the report: logs/metrics_<run id>.json
+write_run_metrics() {
+    local exit_code="$1"
+    local metrics_file="$LOG_DIR/metrics_${RUN_ID}.json"
+    local duration=0
+    if [ -n "$RUN_START_TIME" ]; then
+        duration=$(($(date +%s) - RUN_START_TIME))
     fi
+
+    local task iterations seconds start end status first=true
+    {
+        echo "{"
+        echo "  \"run_id\": \"${RUN_ID}\","
+        echo "  \"exit_code\": ${exit_code},"
+        echo "  \"duration_seconds\": ${duration},"
+        echo "  \"iterations\": ${#REPORT_ROWS[@]},"
+        echo "  \"tasks\": ["
+        local diff_stat files insertions deletions
+        while IFS=$'\t' read -r task iterations seconds start end status; do
+            [ -n "$task" ] || continue
+            if [ "$first" = "false" ]; then
+                echo ","
+            fi
+            first=false
+            printf '    {"id": "%s", "status": "%s", "iterations": %d, "duration_seconds": %d, "started_at": "%s", "finished_at": "%s"' \
+                "$task" "$status" "$iterations" "$seconds" "$(format_timestamp "$start")" "$(format_timestamp "$end")"
+            diff_stat=$(get_task_diff_stat "$task")
+            if [ -n "$diff_stat" ]; then
+                IFS=$'\t' read -r files insertions deletions <<< "$diff_stat"
+                printf ', "files_changed": %d, "insertions": %d, "deletions": %d' "$files" "$insertions" "$deletions"
+            fi
+            printf '}'
+        done <<< "$(summarize_task_times)"
+        if [ "$first" = "false" ]; then
+            echo ""
+        fi
+        echo "  ]"
+        echo "}"
+    } > "$metrics_file"
 }
 
-# Run test script
-run_tests() {
-    if [ -x "$TEST_SCRIPT" ]; then
-        "$TEST_SCRIPT"
-    else
-        log "${YELLOW}⚠ Test script not found or not executable: $TEST_SCRIPT${NC}"
-        return 0
-    fi
+# Format seconds as "Xm Ys"
+format_duration() {
+    local secs="$1"
+    echo "$((secs / 60))m $((secs % 60))s"
 }
 
-verify_build() {
-    if [ "$BUILD_GATE_ENABLED" != "true" ]; then
-        return 0
+# Overall progress, e.g. "40%" or "40% • ETA ~6m 0s" once this run has
+# completed a task (ETA = average time per completed task x remaining)
+format_progress() {
+    local completed="$1"
+    local remaining="$2"
+    local completed_this_run="$3"
+    local total=$((completed + remaining))
+    local percent=100
+    if [ "$total" -gt 0 ]; then
+        percent=$((completed * 100 / total))
     fi
 
-    local build_log=$(mktemp)
-    local start_time=$(date +%s)
-
-    # Start spinner in background
-    start_build_spinner "Building..." &
-    BUILD_SPINNER_PID=$!
+    if [ "$completed_this_run" -gt 0 ] && [ "$remaining" -gt 0 ] && [ -n "$RUN_START_TIME" ]; then
+        local elapsed=$(($(date +%s) - RUN_START_TIME))
+        local eta=$((elapsed / completed_this_run * remaining))
+        echo "${percent}% • ETA ~$(format_duration "$eta")"
+    else
+        echo "${percent}%"
+    fi
+}
 
-    cd "$PROJECT_DIR"
-    set +e
-    run_build > "$build_log" 2>&1
-    local build_result=$?
-    set -e
-    cd - > /dev/null
+write_run_report() {
+    local exit_code="$1"
+    local report_file="$LOG_DIR/report_${RUN_ID}.md"
+    local duration=0
+    if [ -n "$RUN_START_TIME" ]; then
+        duration=$(($(date +%s) - RUN_START_TIME))
+    fi
 
-    # Stop spinner
-    stop_build_spinner
+    local completed failed
+    read -r completed failed <<< "$(count_iteration_results)"
 
-    local elapsed=$(($(date +%s) - start_time))
+    local outcome="Finished"
+    if [ "$exit_code" -ne 0 ]; then
+        outcome="Stopped with errors (exit code $exit_code)"
+    fi
 
-    if [ $build_result -ne 0 ]; then
-        log "${RED}❌ Build failed${NC} (${elapsed}s)"
-        log ""
-        log "${YELLOW}Build output (last 20 lines):${NC}"
-        tail -20 "$build_log" | while IFS= read -r line; do
-            log "  $line"
+    {
+        echo "# Ralph Loop Run Report"
+        echo ""
+        echo "- **Run ID:** ${RUN_ID}"
+        echo "- **Branch:** $(git -C "$PROJECT_DIR" rev-parse --abbrev-ref HEAD 2>/dev/null)"
+        echo "- **Agent:** ${AGENT_TYPE} (model: ${SELECTED_MODEL:-default})"
+        echo "- **Outcome:** ${outcome}"
+        if [ -n "$STOP_REASON" ]; then
+            echo "- **Stopped because:** ${STOP_REASON}"
+        fi
+        echo ""
+        echo "## Summary"
+        echo ""
+        echo "| Metric | Value |"
+        echo "|--------|-------|"
+        echo "| Tasks completed | ${completed} |"
+        echo "| Failed iterations | ${failed} |"
+        echo "| Blocked tasks | ${#BLOCKED_TASK_IDS[@]} |"
+        echo "| Tasks remaining | $(count_unfinished) |"
+        echo "| Iterations | ${#REPORT_ROWS[@]} |"
+        echo "| Duration | $(format_duration "$duration") |"
+        echo ""
+        if [ ${#BLOCKED_TASK_IDS[@]} -gt 0 ]; then
+            local blocked_index
+            echo "## Blocked Tasks"
+            echo ""
+            for blocked_index in "${!BLOCKED_TASK_IDS[@]}"; do
+                echo "- **${BLOCKED_TASK_IDS[$blocked_index]}:** ${BLOCKED_TASK_REASONS[$blocked_index]}"
+            done
+            echo ""
+        fi
+        local task_times=$(summarize_task_times)
+        if [ -n "$task_times" ]; then
+            local task_id task_iterations task_seconds task_start task_end task_status diff_stat changes
+            echo "## Task Timing"
+            echo ""
+            echo "| Task | Status | Iterations | Time | Started | Finished | Changes |"
+            echo "|------|--------|------------|------|---------|----------|---------|"
+            while IFS=$'\t' read -r task_id task_iterations task_seconds task_start task_end task_status; do
+                diff_stat=$(get_task_diff_stat "$task_id")
+                changes="-"
+                if [ -n "$diff_stat" ]; then
+                    changes=$(format_diff_stat ${diff_stat})
+                fi
+                echo "| ${task_id} | ${task_status} | ${task_iterations} | $(format_duration "$task_seconds") | $(format_timestamp "$task_start") | $(format_timestamp "$task_end") | ${changes} |"
+            done <<< "$task_times"
+            echo ""
+        fi
+        local row iter task status task_duration iter_log model started ended
+        echo "## Tasks"
+        for row in "${REPORT_ROWS[@]}"; do
+            IFS=$'\t' read -r iter task status task_duration iter_log model started ended <<< "$row"
+            echo ""
+            echo "### ${task}"
+            echo ""
+            echo "- **Status:** ${status}"
+            echo "- **Iteration:** ${iter}"
+            echo "- **Duration:** ${task_duration}"
+            echo "- **Model:** ${model}"
+            echo "- **Log:** \`${iter_log}\`"
+            if [ -f "$iter_log" ]; then
+                echo ""
+                echo "<details><summary>Final agent output</summary>"
+                echo ""
+                echo "\`\`\`"
+                truncate_output "$iter_log" "$REPORT_OUTPUT_LINES"
+                echo "\`\`\`"
+                echo ""
+                echo "</details>"
+            fi
         done
-        rm -f "$build_log"
-        return 1
-    fi
+        echo ""
+        echo "## Commits"
+        echo ""
+        local commits=""
+        if [ -n "$RUN_START_HEAD" ]; then
+            commits=$(git -C "$PROJECT_DIR" log --reverse --format='- `%h` %s' "${RUN_START_HEAD}..HEAD" 2>/dev/null)
+        fi
+        if [ -n "$commits" ]; then
+            echo "$commits"
+        else
+            echo "No commits were made in this run."
+        fi
+    } > "$report_file"
 
-    log "${GREEN}✓ Build succeeded${NC} (${elapsed}s)"
-    rm -f "$build_log"
-    return 0
+    log "Run report: ${report_file}"
 }
 
 #==============================================================================
-# TEST VERIFICATION
+# HOOKS
 #==============================================================================
+#
+# Optional executable scripts in .ralph/hooks/, run from the project directory:
+#   pre_loop.sh  - Once before the initial build/test checks (e.g. start a database)
+#   pre_task.sh  - Before each iteration; its output is added to the agent prompt
+#   post_loop.sh - Once when the run ends, even on failure (best-effort)
+#
+# Hooks get RALPH_RUN_ID and RALPH_PROJECT_DIR in their environment;
+# pre_task.sh also gets RALPH_NEXT_TASK, and post_loop.sh gets RALPH_EXIT_CODE.
+#
 
-# Test gate settings (can be overridden in config.sh)
-TEST_GATE_ENABLED="${TEST_GATE_ENABLED:-true}"
-TEST_FIX_ATTEMPTS="${TEST_FIX_ATTEMPTS:-1}"
+HOOKS_DIR="$RALPH_CONFIG_DIR/hooks"
 
-verify_tests() {
-    if [ "$TEST_GATE_ENABLED" != "true" ]; then
-        return 0
-    fi
+# Wait for a background process, killing it after timeout_secs (0 = no limit).
+# Returns the process's exit code, or 124 if it timed out.
+wait_with_timeout() {
+    local pid="$1"
+    local timeout_secs="$2"
 
-    # Check if test script exists and is executable
-    if [ ! -x "$TEST_SCRIPT" ]; then
-        log "${YELLOW}⚠ No test script found - skipping test verification${NC}"
-        log "${YELLOW}  Create .ralph/test.sh to enable test gates${NC}"
-        return 0
+    if [ "$timeout_secs" -gt 0 ] && watch_process "$pid" 1 deadline_passed $(($(date +%s) + timeout_secs)); then
+        wait "$pid" 2>/dev/null
+        return 124
     fi
 
-    local test_log=$(mktemp)
-    local start_time=$(date +%s)
+    wait "$pid"
+}
 
-    # Start spinner in background
-    start_build_spinner "Running tests..." &
-    BUILD_SPINNER_PID=$!
+# Run a hook script if it exists. Returns the hook's exit code.
+# Output goes to hook_log (default: logs/<name>_<run id>.log).
+run_hook() {
+    local name="$1"
+    local hook_log="${2:-$LOG_DIR/${name}_${RUN_ID}.log}"
+    local hook="$HOOKS_DIR/${name}.sh"
 
-    cd "$PROJECT_DIR"
-    set +e
-    run_tests > "$test_log" 2>&1
-    local test_result=$?
-    set -e
-    cd - > /dev/null
+    if [ ! -x "$hook" ]; then
+        return 0
+    fi
 
-    # Stop spinner
-    stop_build_spinner
+    log "${CYAN}▶ Running ${name} hook...${NC}"
 
-    local elapsed=$(($(date +%s) - start_time))
+    (cd "$PROJECT_DIR" && RALPH_RUN_ID="$RUN_ID" RALPH_PROJECT_DIR="$PROJECT_DIR" "$hook") > "$hook_log" 2>&1 &
 
-    if [ $test_result -ne 0 ]; then
-        log "${RED}❌ Tests failed${NC} (${elapsed}s)"
-        log ""
-        log "${YELLOW}Test output (last 30 lines):${NC}"
-        tail -30 "$test_log" | while IFS= read -r line; do
-            log "  $line"
-        done
-        rm -f "$test_log"
-        return 1
+    local exit_code=0
+    wait_with_timeout $! "$HOOK_TIMEOUT_SECONDS" || exit_code=$?
+    redact_file "$hook_log"
+
+    if [ $exit_code -eq 124 ]; then
+        log "${RED}❌ ${name} hook timed out after ${HOOK_TIMEOUT_SECONDS}s${NC}"
+        log "   Log: $hook_log"
+        return $exit_code
+    elif [ $exit_code -ne 0 ]; then
+        log "${RED}❌ ${name} hook failed (exit ${exit_code})${NC}"
+        log "   Log: $hook_log"
+        return $exit_code
     fi
 
-    log "${GREEN}✓ All tests passed${NC} (${elapsed}s)"
-    rm -f "$test_log"
+    log "${GREEN}✓ ${name} hook succeeded${NC}"
     return 0
 }
 
-TEST_FIX_PROMPT="CRITICAL: Tests are failing and must be fixed before continuing.
-
-Your ONLY task right now is to fix the failing tests. Do not work on any tasks from the task list.
-
-Steps:
-1. Run the test suite to see which tests are failing
-2. Analyze the test failures - understand what's expected vs actual
-3. Determine the root cause. Consider ALL possibilities:
-   - The implementation code may be wrong
-   - The test itself may be wrong (incorrect expectations, outdated assertions)
-   - The test script (.ralph/test.sh) may have issues (timeouts, missing dependencies, incorrect commands)
-   - There may be environment or configuration issues
-4. Fix the issue properly - don't just make tests pass with hacks
-5. Run tests again to verify they pass
-6. If you fix implementation code, make sure the build still passes
-
-Important: If the test script itself is misconfigured (wrong commands, insufficient timeouts, etc.), fix the test script. Check .ralph/test.sh if tests are timing out or failing to run properly.
-
-When all tests pass, output: FIXED
-If you cannot fix the tests, output: ERROR: <description of the problem>
+run_pre_loop_hook() {
+    if run_hook "pre_loop"; then
+        return 0
+    fi
 
-Do NOT output NEXT or DONE - only FIXED or ERROR."
+    if [ "$PRE_LOOP_HOOK_ON_FAILURE" = "continue" ]; then
+        log "${YELLOW}⚠ Continuing despite pre_loop hook failure${NC}"
+        return 0
+    fi
 
-attempt_test_fix() {
-    local fix_log="$LOG_DIR/test_fix_${RUN_ID}_$(date +%H%M%S).log"
+    log "${RED}STOPPING: pre_loop hook failed${NC}"
+    exit 1
+}
 
-    log "${YELLOW}🔧 Attempting to fix failing tests...${NC}"
-    log "   Log: $fix_log"
+# Run the pre_task hook and keep its output for build_prompt.
+# Failures are logged but never stop the loop.
+run_pre_task_hook() {
+    local next_task="$1"
+    local hook_log="$2"
 
-    if run_agent "$fix_log" "$TEST_FIX_PROMPT"; then
-        local output=$(cat "$fix_log")
+    PRE_TASK_HOOK_OUTPUT=""
 
-        if echo "$output" | grep -q "^FIXED$\|FIXED$"; then
-            log "${GREEN}✓ Test fix reported success${NC}"
+    if [ ! -x "$HOOKS_DIR/pre_task.sh" ]; then
+        return 0
+    fi
 
-            # Verify the fix actually worked
-            if verify_tests; then
-                # Also verify build still passes
-                if verify_build; then
-                    # Commit the fix
-                    if [ "$AUTO_COMMIT" = "true" ]; then
-                        commit_changes "TEST-FIX" "Fix failing tests"
-                    fi
-                    return 0
-                else
-                    log "${RED}❌ Build broken after test fix${NC}"
-                    return 1
-                fi
-            else
-                log "${RED}❌ Tests still failing after fix attempt${NC}"
-                return 1
-            fi
-        elif echo "$output" | grep -q "^ERROR:\|ERROR:"; then
-            local error_msg=$(echo "$output" | grep "ERROR:" | head -1)
-            log "${RED}❌ Test fix failed: $error_msg${NC}"
-            return 1
-        else
-            log "${YELLOW}⚠ No status marker from test fix attempt${NC}"
-            # Check if tests pass anyway
-            if verify_tests; then
-                return 0
-            fi
-            return 1
-        fi
+    if RALPH_NEXT_TASK="$next_task" run_hook "pre_task" "$hook_log"; then
+        PRE_TASK_HOOK_OUTPUT=$(cat "$hook_log")
+    elif [ "$INCLUDE_FAILED_HOOK_OUTPUT" = "true" ]; then
+        PRE_TASK_HOOK_OUTPUT=$(cat "$hook_log")
     else
-        log "${RED}❌ Test fix agent failed${NC}"
-        return 1
+        log "${YELLOW}⚠ Continuing without pre_task hook output${NC}"
     fi
 }
 
+# Called from the EXIT trap with the script's exit code
+run_post_loop_hook() {
+    local exit_code="${1:-0}"
+    export RALPH_EXIT_CODE=$exit_code
+    run_hook "post_loop" || log "${YELLOW}⚠ post_loop hook failed - ignoring${NC}"
+    return $exit_code
+}
+
 #==============================================================================
-# REVIEW MODE
+# NOTIFICATIONS
 #==============================================================================
 
-REVIEW_PROMPT="You are a code reviewer. Your job is to review recent changes and ensure quality.
-
-## Your Task
-
-Review the last few commits and check for:
-
-### 1. Code Quality
-- Is the code clean and readable?
-- Are there any TODO comments that should be resolved?
-- Is there dead code, unused imports, or commented-out code?
-- Is error handling appropriate?
-
-### 2. Consistency
-- Do the changes follow existing patterns in the codebase?
-- Is naming consistent with the rest of the project?
-- Does the code style match the project conventions?
+# Show a desktop notification with whatever the platform provides
+send_desktop_notification() {
+    local message="$1"
 
-### 3. Completeness
-- Are there any incomplete implementations?
-- Are edge cases handled?
-- Is there appropriate test coverage?
+    if command -v osascript &> /dev/null; then
+        osascript -e "display notification \"${message//\"/\\\"}\" with title \"Ralph Loop\"" 2>&1
+    elif command -v notify-send &> /dev/null; then
+        notify-send "Ralph Loop" "$message" 2>&1
+    else
+        echo "neither osascript nor notify-send is available"
+        return 1
+    fi
+}
 
-### 4. Documentation
-- Are public APIs documented?
-- Are complex algorithms explained?
+# Called from the EXIT trap: run NOTIFY_COMMAND and/or show a desktop
+# notification with the outcome. Problems are logged and otherwise ignored.
+notify_run_finished() {
+    local exit_code="$1"
 
-## What to Do
+    if [ -z "$NOTIFY_COMMAND" ] && [ "$NOTIFY_DESKTOP" != "true" ]; then
+        return 0
+    fi
 
-1. Run: git log --oneline -5 to see recent commits
-2. Run: git diff HEAD~3 to see recent changes (adjust number as needed)
-3. Review the changes against the criteria above
-4. Fix any issues you find
-5. Run build and tests to verify your fixes
+    local status="success"
+    if [ "$exit_code" -eq 130 ]; then
+        status="interrupted"
+    elif [ "$exit_code" -ne 0 ]; then
+        status="failed"
+    fi
 
-## Output
+    local completed failed
+    read -r completed failed <<< "$(count_iteration_results)"
+
+    if [ -n "$NOTIFY_COMMAND" ]; then
+        local command="$NOTIFY_COMMAND"
+        command="${command//\{status\}/$status}"
+        command="${command//\{completed\}/$completed}"
+        command="${command//\{failed\}/$failed}"
+        local notify_log="$LOG_DIR/notify_${RUN_ID}.log"
+
+        (cd "$PROJECT_DIR" && bash -c "$command") > "$notify_log" 2>&1 &
+        local notify_exit=0
+        wait_with_timeout $! "$HOOK_TIMEOUT_SECONDS" || notify_exit=$?
+        redact_file "$notify_log"
+        if [ "$notify_exit" -ne 0 ]; then
+            log "${YELLOW}⚠ NOTIFY_COMMAND failed (exit ${notify_exit}) - ignoring${NC}"
+            log "   Log: $notify_log"
+        fi
+    fi
 
-When review is complete:
-- If you made fixes: output FIXED
-- If no issues found: output CLEAN
-- If you found issues you cannot fix: output ERROR: <description>
+    if [ "$NOTIFY_DESKTOP" = "true" ]; then
+        local error
+        if ! error=$(send_desktop_notification "Run ${status}: ${completed} task(s) completed, ${failed} failed iteration(s)"); then
+            log "${YELLOW}⚠ Desktop notification failed: ${error} - ignoring${NC}"
+        fi
+    fi
+}
 
-Do NOT output NEXT or DONE."
+#==============================================================================
+# DRY RUN
+#==============================================================================
 
-run_review() {
-    if [ "$REVIEW_MODE_ENABLED" != "true" ]; then
-        return 0
-    fi
+# Show the prompt the agent would receive without running anything.
+# Skips branch checks, build/test gates, and commits.
+run_dry_run() {
+    local prompt_log="$LOG_DIR/dry_run_${RUN_ID}.log"
 
-    local review_log="$LOG_DIR/review_${RUN_ID}_$(date +%H%M%S).log"
+    log ""
+    log "${CYAN}Dry run - the agent will not be called${NC}"
+    log "Next task:  $(get_next_task)"
+    log "Remaining:  $(count_remaining)"
+    log "Prompt log: ${prompt_log}"
+    log ""
 
-    log "${CYAN}🔍 Running code review...${NC}"
-    log "   Log: $review_log"
+    build_prompt > "$prompt_log"
+    cat "$prompt_log"
+}
 
-    if run_agent "$review_log" "$REVIEW_PROMPT"; then
-        local output=$(cat "$review_log")
+#==============================================================================
+# TASK APPROVAL
+#==============================================================================
 
-        if echo "$output" | grep -q "^FIXED$\|FIXED$"; then
-            log "${GREEN}✓ Review found and fixed issues${NC}"
+# With REQUIRE_APPROVAL, ask before each task. Prints "run", "skip", "abort"
+# or "model" (switch models, then ask again).
+# Answers come from the terminal, or one per line from stdin when it is piped
+# (e.g. printf 'r\ns\nr\n' | ralph_loop.sh --approve); end of input aborts.
+ask_task_approval() {
+    local task="$1"
+    local response
 
-            # Verify build and tests still pass
-            if verify_build && verify_tests; then
-                if [ "$AUTO_COMMIT" = "true" ]; then
-                    commit_changes "REVIEW" "Code review cleanup"
-                fi
-                return 0
+    while true; do
+        echo -en "${BOLD}Run ${task%%:*} with ${SELECTED_MODEL:-the default model}? [r]un / [s]kip / [a]bort / [m]odel: ${NC}" >&2
+        if ! read -r response; then
+            echo "" >&2
+            echo "abort"
+            return 0
+        fi
+        response=$(echo "$response" | tr '[:upper:]' '[:lower:]' | tr -d '[:space:]')
+        case "$response" in
+            r|run|y|yes) echo "run"; return 0 ;;
+            s|skip) echo "skip"; return 0 ;;
+            a|abort|q|quit) echo "abort"; return 0 ;;
+            m|model) echo "model"; return 0 ;;
+        esac
+        echo "Please answer r, s, a or m." >&2
+    done
+}
+
+# Pick the model for this and later tasks from the agent's list (a number
+# or a name; empty keeps the current one). Reads the same input as the
+# approval prompt. Not run in a subshell, so SELECTED_MODEL sticks.
+ask_model_switch() {
+    local models_list=$(get_available_models)
+    if [ "$models_list" = "default" ]; then
+        models_list=""
+    fi
+
+    if [ -n "$models_list" ]; then
+        local i=1 model
+        echo "" >&2
+        while IFS= read -r model; do
+            if [ "$model" = "$SELECTED_MODEL" ]; then
+                echo -e "  $i) $model ${YELLOW}(current)${NC}" >&2
             else
-                log "${RED}❌ Build or tests broken after review fixes${NC}"
-                return 1
+                echo "  $i) $model" >&2
             fi
-        elif echo "$output" | grep -q "^CLEAN$\|CLEAN$"; then
-            log "${GREEN}✓ Review passed - no issues found${NC}"
-            return 0
-        elif echo "$output" | grep -q "^ERROR:\|ERROR:"; then
-            local error_msg=$(echo "$output" | grep "ERROR:" | head -1)
-            log "${YELLOW}⚠ Review found issues: $error_msg${NC}"
-            # Don't fail the run, just log the warning
-            return 0
-        else
-            log "${YELLOW}⚠ No status marker from review${NC}"
+            i=$((i + 1))
+        done <<< "$models_list"
+    fi
+
+    local choice
+    echo -en "${BOLD}Model (number or name, empty to keep ${SELECTED_MODEL:-the default}): ${NC}" >&2
+    if ! read -r choice; then
+        echo "" >&2
+        return 0
+    fi
+    choice=$(echo "$choice" | tr -d '[:space:]')
+    if [ -z "$choice" ]; then
+        return 0
+    fi
+
+    local new_model="$choice"
+    if [[ "$choice" =~ ^[0-9]+$ ]] && [ -n "$models_list" ]; then
+        new_model=$(echo "$models_list" | sed -n "${choice}p")
+        if [ -z "$new_model" ]; then
+            log "${YELLOW}⚠ No model number ${choice} - keeping ${SELECTED_MODEL:-the default}${NC}"
             return 0
         fi
-    else
-        log "${YELLOW}⚠ Review agent failed - continuing anyway${NC}"
-        return 0
+    elif [ -n "$models_list" ] && ! echo "$models_list" | grep -qxF -- "$new_model"; then
+        log "${YELLOW}⚠ '${new_model}' is not in the models ${AGENT_TYPE} lists - using it anyway${NC}"
+    fi
+
+    if [ "$new_model" != "$SELECTED_MODEL" ]; then
+        log "${CYAN}🔀 Switched model from ${SELECTED_MODEL:-default} to ${new_model} (from ${CURRENT_TASK_ID})${NC}"
+        SELECTED_MODEL="$new_model"
     fi
 }
 
 #==============================================================================
-# BUILD FIX MODE
+# AGENT TEST
 #==============================================================================
 
-BUILD_FIX_PROMPT="CRITICAL: The build is broken and must be fixed before any other work.
+# Send a throwaway prompt to the configured agent and model and show what
+# came back. Tasks, hooks, gates and git are left alone.
+run_agent_test() {
+    local prompt="$AGENT_TEST_PROMPT"
+    if [ -z "$prompt" ] && [ ! -t 0 ]; then
+        prompt=$(cat)
+    fi
+    if [ -z "$prompt" ]; then
+        log "${RED}ERROR: --agent-test needs a prompt: --prompt TEXT or pipe one on stdin${NC}"
+        return 1
+    fi
 
-Your ONLY task right now is to fix the build. Do not work on any tasks from the task list.
+    local test_log="$LOG_DIR/agent_test_${RUN_ID}.log"
 
-Steps:
-1. Run the build command to see the errors
-2. Analyze the error messages
-3. Fix the issues causing the build to fail
-4. Verify the build succeeds
-5. If tests are required, run them too
+    log ""
+    log "${CYAN}Agent test - tasks and git are not touched${NC}"
+    log "Agent:      ${AGENT_TYPE}"
+    log "Model:      ${SELECTED_MODEL:-default}"
+    log "Log:        ${test_log}"
+    log ""
 
-When the build is fixed and passing, output: FIXED
-If you cannot fix the build, output: ERROR: <description of the problem>
+    local start_time=$(date +%s)
+    run_agent "$test_log" "$prompt" agent_test
+    local duration=$(($(date +%s) - start_time))
+
+    local output=$(cat "$test_log" 2>/dev/null)
+    local status="no status marker"
+    if output_has_status ERROR "$output"; then
+        status=$(get_status_line ERROR "$output")
+    elif output_has_status DONE "$output"; then
+        status="DONE"
+    elif output_has_status NEXT "$output"; then
+        status="NEXT"
+    fi
 
-Do NOT output NEXT or DONE - only FIXED or ERROR."
+    log ""
+    log "${BLUE}Output:${NC}"
+    log "$output"
+    log ""
+    log "Status:     ${status}"
+    log "Exit code:  ${AGENT_EXIT_CODE}"
+    log "Duration:   $(format_duration "$duration")"
 
-attempt_build_fix() {
-    local fix_log="$LOG_DIR/build_fix_${RUN_ID}_$(date +%H%M%S).log"
+    if [ "$AGENT_EXIT_CODE" -ne 0 ] && agent_needs_login "$test_log"; then
+        log ""
+        show_agent_login_help
+    fi
 
-    log "${YELLOW}🔧 Attempting to fix build...${NC}"
-    log "   Log: $fix_log"
+    return $AGENT_EXIT_CODE
+}
 
-    if run_agent "$fix_log" "$BUILD_FIX_PROMPT"; then
-        local output=$(cat "$fix_log")
+#==============================================================================
+# MAIN LOOP
+#==============================================================================
 
-        if echo "$output" | grep -q "^FIXED$\|FIXED$"; then
-            log "${GREEN}✓ Build fix reported success${NC}"
+# EXIT trap, so the report and post_loop hook also run when the loop stops on an error
+finish_run() {
+    local exit_code=$?
+    redact_agent_log
+    if [ "$RUN_REPORT_ENABLED" = "true" ]; then
+        write_run_report "$exit_code"
+        write_run_metrics "$exit_code"
+    fi
+    notify_run_finished "$exit_code"
+    release_run_lock
+    run_post_loop_hook "$exit_code"
+}
 
-            # Verify the fix actually worked
-            if verify_build; then
-                # Commit the fix
-                if [ "$AUTO_COMMIT" = "true" ]; then
-                    commit_changes "BUILD-FIX" "Fix broken build"
-                fi
-                return 0
-            else
-                log "${RED}❌ Build still failing after fix attempt${NC}"
-                return 1
-            fi
-        elif echo "$output" | grep -q "^ERROR:\|ERROR:"; then
-            local error_msg=$(echo "$output" | grep "ERROR:" | head -1)
-            log "${RED}❌ Build fix failed: $error_msg${NC}"
-            return 1
-        else
-            log "${YELLOW}⚠ No status marker from build fix attempt${NC}"
-            # Check if build works anyway
-            if verify_build; then
-                return 0
-            fi
-            return 1
-        fi
-    else
-        log "${RED}❌ Build fix agent failed${NC}"
-        return 1
+# INT/TERM trap: stop the running agent right away rather than leaving it
+# working in the background, then exit (finish_run still writes the report).
+# A second Ctrl+C while that is happening force-quits.
+handle_interrupt() {
+    trap force_quit INT TERM
+    echo ""
+    echo -e "${YELLOW}Stopping... (press Ctrl+C again to force quit)${NC}"
+    if [ -n "$PROGRESS_PID" ] && kill -0 "$PROGRESS_PID" 2>/dev/null; then
+        stop_agent_display
+    fi
+    if [ -n "$AGENT_PID" ] && kill -0 "$AGENT_PID" 2>/dev/null; then
+        kill_process_tree "$AGENT_PID"
+        log "${YELLOW}Stopped the running agent${NC}"
     fi
+    redact_agent_log
+    log ""
+    log "${RED}Interrupted - stopping run${NC}"
+    exit 130
+}
+
+# Kill a process and all of its descendants, children first
+kill_process_tree() {
+    local pid="$1"
+    local child
+    for child in $(pgrep -P "$pid" 2>/dev/null); do
+        kill_process_tree "$child"
+    done
+    kill "$pid" 2>/dev/null || true
+}
+
+# Second Ctrl+C: abandon the rest of shutdown (report, post_loop hook)
+# and kill everything the loop started
+force_quit() {
+    trap - EXIT INT TERM
+    echo ""
+    echo -e "${RED}Force quitting - killing all child processes${NC}"
+    local child
+    for child in $(pgrep -P $$ 2>/dev/null); do
+        kill_process_tree "$child"
+    done
+    redact_agent_log
+    release_run_lock
+    exit 130
 }
 
 #==============================================================================
-# GIT OPERATIONS
+# RUN LOCK
 #==============================================================================
 
-commit_changes() {
-    local task_id="$1"
-    local task_desc="$2"
+# Only one loop may run in a checkout at a time; two would race on TASKS.md
+# and git. The lock file lives in the git directory so it is never committed.
+# It holds the owner's PID and run ID.
+RUN_LOCK_FILE=""
+RUN_LOCK_HELD=false
 
-    if [ "$AUTO_COMMIT" != "true" ]; then
-        return 0
-    fi
+# noclobber makes creating the file atomic, so of two runs starting at the
+# same time only one gets the lock
+create_run_lock() {
+    ( set -o noclobber; echo "$$ $RUN_ID" > "$RUN_LOCK_FILE" ) 2>/dev/null
+}
 
-    cd "$PROJECT_DIR"
+acquire_run_lock() {
+    local git_dir=$(git -C "$PROJECT_DIR" rev-parse --absolute-git-dir 2>/dev/null)
+    RUN_LOCK_FILE="${git_dir:-$RALPH_CONFIG_DIR}/ralph.lock"
 
-    # Check for uncommitted changes
-    if git diff --quiet HEAD 2>/dev/null && git diff --cached --quiet 2>/dev/null; then
-        if [ -z "$(git ls-files --others --exclude-standard)" ]; then
-            log "${YELLOW}No changes to commit${NC}"
-            cd - > /dev/null
-            return 0
-        fi
+    if create_run_lock; then
+        RUN_LOCK_HELD=true
+        return 0
     fi
 
-    # Stage all changes
-    git add -A
+    local holder_pid holder_run
+    read -r holder_pid holder_run < "$RUN_LOCK_FILE" 2>/dev/null || true
 
-    # Build commit message
-    local commit_msg
-    if [ -n "$COMMIT_SCOPE" ]; then
-        commit_msg="${COMMIT_PREFIX}(${COMMIT_SCOPE}): ${task_id} - ${task_desc}"
+    # A run that was killed outright (or a crash) leaves its lock behind
+    if [ -z "$holder_pid" ] || ! kill -0 "$holder_pid" 2>/dev/null; then
+        log "${YELLOW}⚠ Removing stale lock from run ${holder_run:-unknown} (PID ${holder_pid:-unknown} is no longer running)${NC}"
+    elif [ "$FORCE_LOCK" = "true" ]; then
+        log "${YELLOW}⚠ Taking over the lock from run ${holder_run:-unknown} (PID ${holder_pid}) because of --force${NC}"
     else
-        commit_msg="${COMMIT_PREFIX}: ${task_id} - ${task_desc}"
+        log "${RED}ERROR: Another Ralph Loop run is active in this project${NC}"
+        log "${RED}   Run ${holder_run:-unknown}, PID ${holder_pid}${NC}"
+        log "Wait for it to finish, or stop it (Ctrl+C in its terminal, or kill ${holder_pid})."
+        log "Run again afterwards to pick up from the first unchecked task."
+        log "If that PID isn't a Ralph Loop run, start anyway with --force."
+        return 1
     fi
 
-    if git commit -m "$commit_msg" 2>&1; then
-        log "${GREEN}✓ Committed: ${commit_msg}${NC}"
-    else
-        log "${YELLOW}⚠ Git commit returned non-zero${NC}"
+    rm -f "$RUN_LOCK_FILE"
+    if ! create_run_lock; then
+        log "${RED}ERROR: Another Ralph Loop run took the lock at the same time${NC}"
+        return 1
     fi
-
-    cd - > /dev/null
+    RUN_LOCK_HELD=true
 }
 
-#==============================================================================
-# MAIN LOOP
-#==============================================================================
+# Leaves the file alone if another run took it over with --force
+release_run_lock() {
+    if [ "$RUN_LOCK_HELD" = "true" ]; then
+        local holder_pid
+        read -r holder_pid _ < "$RUN_LOCK_FILE" 2>/dev/null || true
+        if [ "$holder_pid" = "$$" ]; then
+            rm -f "$RUN_LOCK_FILE"
+        fi
+        RUN_LOCK_HELD=false
+    fi
+}
 
 main() {
+    if [ "$DRY_RUN" = "true" ]; then
+        run_dry_run
+        return 0
+    fi
+
+    if [ "$AGENT_TEST" = "true" ]; then
+        run_agent_test
+        return
+    fi
+
+    if ! acquire_run_lock; then
+        exit 1
+    fi
+    trap release_run_lock EXIT
+
     # Verify we're on an appropriate branch
     verify_branch
 
@@ -1082,25 +4256,70 @@ main() {
     log "Run ID:         ${RUN_ID}"
     log "Project:        ${PROJECT_DIR}"
     log "Agent:          ${AGENT_TYPE}"
+    if [ -n "$PROFILE" ]; then
+        log "Profile:        ${PROFILE}"
+    fi
+    if [ -n "$USER_CONFIG_FILE" ]; then
+        log "User config:    ${USER_CONFIG_FILE}"
+    fi
     log "Model:          ${SELECTED_MODEL:-default}"
+    if [ -n "$MODEL_FALLBACKS" ]; then
+        log "Fallbacks:      ${MODEL_FALLBACKS}"
+    fi
+    if [ -n "$CUSTOM_AGENT_VERSION" ]; then
+        log "Agent version:  ${CUSTOM_AGENT_VERSION}"
+    fi
     log "Max iterations: ${MAX_ITERATIONS}"
+    if [ "$(get_agent_timeout_minutes)" -gt 0 ]; then
+        log "Agent timeout:  $(get_agent_timeout_minutes)m ($(get_agent_timeout_setting))"
+    fi
+    if [ "$MAX_RUN_MINUTES" -gt 0 ]; then
+        log "Time budget:    ${MAX_RUN_MINUTES}m"
+    fi
     log "Task file:      ${TASK_FILE}"
+    if [ -n "$TAG_FILTER" ]; then
+        log "Tags:           ${TAG_FILTER}"
+    fi
+    if [ -n "$EXCLUDE_TAG_FILTER" ]; then
+        log "Excluded tags:  ${EXCLUDE_TAG_FILTER}"
+    fi
+    if [ -n "$ONLY_TASKS" ]; then
+        log "Only tasks:     ${ONLY_TASKS//,/, }"
+        local only_id
+        for only_id in ${ONLY_TASKS//,/ }; do
+            if ! grep -qE "^- \[[ x]\] ${only_id}:" "$TASK_FILE"; then
+                log "${YELLOW}⚠ --only: ${only_id} is not in $(basename "$TASK_FILE")${NC}"
+            fi
+        done
+    fi
     log "Log directory:  ${LOG_DIR}"
     if [ "$TEST_RUN_ENABLED" = "true" ]; then
         log "Test run mode:  ${GREEN}ON${NC} (checkpoint after ${TEST_RUN_TASKS} tasks)"
     fi
+    if [ "$REQUIRE_APPROVAL" = "true" ]; then
+        log "Approval:       ${GREEN}ON${NC} (asked before each task)"
+    fi
+    if [ "$VERIFY_GATE_ENABLED" = "true" ]; then
+        log "Verify script:  ${VERIFY_SCRIPT} (${VERIFY_MODE})"
+    fi
+    if [ "$WATCH_CONFIG" = "true" ]; then
+        log "Config reload:  ${GREEN}ON${NC} (checked between tasks)"
+    fi
     log ""
 
+    run_pre_loop_hook
+    RUN_START_TIME=$(date +%s)
+    RUN_START_HEAD=$(git -C "$PROJECT_DIR" rev-parse -q --verify HEAD 2>/dev/null || true)
+    trap finish_run EXIT
+    trap handle_interrupt INT TERM
+
     # Initial build check
     if [ "$BUILD_GATE_ENABLED" = "true" ]; then
         log "${CYAN}Checking initial build state...${NC}"
         if ! verify_build; then
             log "${YELLOW}Build is broken - attempting fix before starting...${NC}"
-            if ! attempt_build_fix; then
-                log "${RED}═══════════════════════════════════════════════════════════════${NC}"
-                log "${RED}STOPPING: Could not fix initial build failure${NC}"
-                log "${RED}═══════════════════════════════════════════════════════════════${NC}"
-                exit 1
+            if ! run_fix_attempts build ""; then
+                stop_run "Could not fix initial build failure"
             fi
         fi
         log ""
@@ -1111,11 +4330,20 @@ main() {
         log "${CYAN}Checking initial test state...${NC}"
         if ! verify_tests; then
             log "${YELLOW}Tests are failing - attempting fix before starting...${NC}"
-            if ! attempt_test_fix; then
-                log "${RED}═══════════════════════════════════════════════════════════════${NC}"
-                log "${RED}STOPPING: Could not fix initial test failures${NC}"
-                log "${RED}═══════════════════════════════════════════════════════════════${NC}"
-                exit 1
+            if ! run_fix_attempts test ""; then
+                stop_run "Could not fix initial test failures"
+            fi
+        fi
+        log ""
+    fi
+
+    # Initial custom verification
+    if [ "$VERIFY_GATE_ENABLED" = "true" ]; then
+        log "${CYAN}Checking initial verification state...${NC}"
+        if ! verify_custom; then
+            log "${YELLOW}Verification is failing - attempting fix before starting...${NC}"
+            if ! run_fix_attempts verify ""; then
+                stop_run "Could not fix initial verification failures"
             fi
         fi
         log ""
@@ -1131,20 +4359,45 @@ main() {
     local tasks_completed_this_run=0
     local checkpoint_passed=false
 
+    if [ "$WATCH_CONFIG" = "true" ]; then
+        CONFIG_SIGNATURE=$(config_signature)
+    fi
+
     while [ $iteration -le $MAX_ITERATIONS ]; do
+        if [ "$WATCH_CONFIG" = "true" ]; then
+            reload_config_if_changed
+        fi
+
         local REMAINING=$(count_remaining)
         local COMPLETED=$(count_completed)
+        local progress=$(format_progress "$COMPLETED" "$REMAINING" "$tasks_completed_this_run")
 
         log ""
         log "${YELLOW}━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━${NC}"
-        log "${YELLOW}  Iteration ${iteration}/${MAX_ITERATIONS}  •  ✅ ${COMPLETED} done  •  📋 ${REMAINING} remaining${NC}"
+        log "${YELLOW}  Iteration ${iteration}/${MAX_ITERATIONS}  •  ✅ ${COMPLETED} done  •  📋 ${REMAINING} remaining  •  ${progress}${NC}"
         log "${YELLOW}━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━${NC}"
 
         if [ "$REMAINING" -eq 0 ]; then
-            log "${GREEN}✓ All tasks completed!${NC}"
+            if [ ${#SKIPPED_TASK_IDS[@]} -gt 0 ] || [ ${#BLOCKED_TASK_IDS[@]} -gt 0 ]; then
+                log "${YELLOW}No tasks left to run - the rest were skipped or blocked${NC}"
+            elif task_filter_active; then
+                log "${GREEN}✓ All tasks matching the filter completed!${NC}"
+            else
+                log "${GREEN}✓ All tasks completed!${NC}"
+            fi
             break
         fi
 
+        # Time budget: don't start new work once it's used up
+        if [ "$MAX_RUN_MINUTES" -gt 0 ]; then
+            local run_elapsed=$(($(date +%s) - RUN_START_TIME))
+            if [ $run_elapsed -ge $((MAX_RUN_MINUTES * 60)) ]; then
+                log ""
+                log "${YELLOW}Time budget of ${MAX_RUN_MINUTES}m reached after $((run_elapsed / 60))m - stopping run${NC}"
+                break
+            fi
+        fi
+
         # Test run checkpoint: pause after first N tasks for user verification
         if [ "$TEST_RUN_ENABLED" = "true" ] && [ "$checkpoint_passed" = "false" ]; then
             if [ $tasks_completed_this_run -ge $TEST_RUN_TASKS ]; then
@@ -1181,9 +4434,28 @@ main() {
 
         # Show next task
         local NEXT_TASK=$(get_next_task)
+        CURRENT_TASK_ID="${NEXT_TASK%%:*}"
         log "${BLUE}📌 Next task: ${NEXT_TASK}${NC}"
         log ""
 
+        if [ "$REQUIRE_APPROVAL" = "true" ]; then
+            local approval=$(ask_task_approval "$NEXT_TASK")
+            while [ "$approval" = "model" ]; do
+                ask_model_switch
+                approval=$(ask_task_approval "$NEXT_TASK")
+            done
+            log_only "Approval for ${CURRENT_TASK_ID}: ${approval}"
+            if [ "$approval" = "skip" ]; then
+                SKIPPED_TASK_IDS+=("$CURRENT_TASK_ID")
+                log "${YELLOW}⏭  Skipped ${CURRENT_TASK_ID} - it stays unchecked${NC}"
+                continue
+            elif [ "$approval" = "abort" ]; then
+                log "${YELLOW}Stopped at the approval prompt before ${CURRENT_TASK_ID}${NC}"
+                break
+            fi
+            log ""
+        fi
+
         # Create iteration log
         local ITER_LOG="$LOG_DIR/iteration_${RUN_ID}_$(printf "%03d" $iteration).log"
 
@@ -1191,6 +4463,18 @@ main() {
         log "   Log: ${ITER_LOG}"
         log ""
 
+        snapshot_task_start "$NEXT_TASK"
+        local PRE_TASK_LOG="$LOG_DIR/pre_task_${RUN_ID}_$(printf "%03d" $iteration).log"
+        run_pre_task_hook "$NEXT_TASK" "$PRE_TASK_LOG"
+
+        # The pre_task hook can set a task aside before the agent starts
+        if [ -x "$HOOKS_DIR/pre_task.sh" ] && output_has_status BLOCKED "$(cat "$PRE_TASK_LOG" 2>/dev/null)"; then
+            local BLOCKED_REASON=$(get_blocked_reason "$PRE_TASK_LOG")
+            block_task "$CURRENT_TASK_ID" "$BLOCKED_REASON"
+            log "${YELLOW}⛔ ${CURRENT_TASK_ID} blocked by the pre_task hook: ${BLOCKED_REASON}${NC}"
+            continue
+        fi
+
         local START_TIME=$(date +%s)
 
         if run_agent "$ITER_LOG"; then
@@ -1201,39 +4485,17 @@ main() {
 
             local OUTPUT=$(cat "$ITER_LOG")
 
-            if echo "$OUTPUT" | grep -q "^NEXT$\|NEXT$"; then
-                local TASK_ID=$(get_last_completed_task_id)
-                local TASK_DESC=$(get_last_completed_task_description)
+            if output_has_status NEXT "$OUTPUT"; then
+                local TASK_ID="$CURRENT_TASK_ID"
+                local TASK_DESC="${NEXT_TASK#*: }"
+                check_task_completed "$TASK_ID"
                 log ""
                 log "${GREEN}✅ SUCCESS: ${TASK_ID} completed in ${MINUTES}m ${SECONDS}s${NC}"
+                record_iteration "$iteration" "$NEXT_TASK" "Completed" "${MINUTES}m ${SECONDS}s" "$ITER_LOG" "$START_TIME" "$END_TIME"
                 consecutive_failures=0
                 tasks_completed_this_run=$((tasks_completed_this_run + 1))
 
-                # Verify build after task completion
-                if [ "$BUILD_GATE_ENABLED" = "true" ]; then
-                    if ! verify_build; then
-                        log "${YELLOW}Build broken after task - attempting fix...${NC}"
-                        if ! attempt_build_fix; then
-                            log "${RED}═══════════════════════════════════════════════════════════════${NC}"
-                            log "${RED}STOPPING: Build broken and could not be fixed${NC}"
-                            log "${RED}═══════════════════════════════════════════════════════════════${NC}"
-                            exit 1
-                        fi
-                    fi
-                fi
-
-                # Verify tests after task completion
-                if [ "$TEST_GATE_ENABLED" = "true" ]; then
-                    if ! verify_tests; then
-                        log "${YELLOW}Tests failing after task - attempting fix...${NC}"
-                        if ! attempt_test_fix; then
-                            log "${RED}═══════════════════════════════════════════════════════════════${NC}"
-                            log "${RED}STOPPING: Tests failing and could not be fixed${NC}"
-                            log "${RED}═══════════════════════════════════════════════════════════════${NC}"
-                            exit 1
-                        fi
-                    fi
-                fi
+                run_post_task_gates "$NEXT_TASK"
 
                 # Commit changes
                 if [ -n "$TASK_ID" ] && [ "$AUTO_COMMIT" = "true" ]; then
@@ -1249,22 +4511,16 @@ main() {
                     fi
                 fi
 
-            elif echo "$OUTPUT" | grep -q "^DONE$\|DONE$"; then
-                local TASK_ID=$(get_last_completed_task_id)
-                local TASK_DESC=$(get_last_completed_task_description)
+            elif output_has_status DONE "$OUTPUT"; then
+                local TASK_ID="$CURRENT_TASK_ID"
+                local TASK_DESC="${NEXT_TASK#*: }"
+                check_task_completed "$TASK_ID"
                 log ""
                 log "${GREEN}🎉 ALL DONE! Final task ${TASK_ID} completed in ${MINUTES}m ${SECONDS}s${NC}"
+                record_iteration "$iteration" "$NEXT_TASK" "Completed" "${MINUTES}m ${SECONDS}s" "$ITER_LOG" "$START_TIME" "$END_TIME"
                 tasks_completed_this_run=$((tasks_completed_this_run + 1))
 
-                # Final build check
-                if [ "$BUILD_GATE_ENABLED" = "true" ]; then
-                    verify_build
-                fi
-
-                # Final test check
-                if [ "$TEST_GATE_ENABLED" = "true" ]; then
-                    verify_tests
-                fi
+                run_post_task_gates "$NEXT_TASK"
 
                 # Commit final changes
                 if [ -n "$TASK_ID" ] && [ "$AUTO_COMMIT" = "true" ]; then
@@ -1280,21 +4536,45 @@ main() {
 
                 break
 
-            elif echo "$OUTPUT" | grep -q "^ERROR:\|ERROR:"; then
-                local ERROR_MSG=$(echo "$OUTPUT" | grep "ERROR:" | head -1)
+            elif output_has_status BLOCKED "$OUTPUT"; then
+                local BLOCKED_REASON=$(get_blocked_reason "$ITER_LOG")
+                log ""
+                log "${YELLOW}⛔ BLOCKED after ${MINUTES}m ${SECONDS}s: ${BLOCKED_REASON}${NC}"
+                log "${YELLOW}   ${CURRENT_TASK_ID} stays unchecked and is skipped for the rest of this run${NC}"
+                record_iteration "$iteration" "$NEXT_TASK" "Blocked" "${MINUTES}m ${SECONDS}s" "$ITER_LOG" "$START_TIME" "$END_TIME"
+                block_task "$CURRENT_TASK_ID" "$BLOCKED_REASON"
+                commit_wip "${NEXT_TASK%%:*}" "$iteration"
+            elif output_has_status ERROR "$OUTPUT"; then
+                local ERROR_MSG=$(get_status_line ERROR "$OUTPUT")
                 log ""
                 log "${RED}❌ ERROR after ${MINUTES}m ${SECONDS}s: ${ERROR_MSG}${NC}"
+                record_iteration "$iteration" "$NEXT_TASK" "Error" "${MINUTES}m ${SECONDS}s" "$ITER_LOG" "$START_TIME" "$END_TIME"
+                commit_wip "${NEXT_TASK%%:*}" "$iteration"
+                consecutive_failures=$((consecutive_failures + 1))
+            elif [ "$AGENT_EXIT_CODE" -ne 0 ] && agent_needs_login "$ITER_LOG"; then
+                # Retrying won't help until someone logs in
+                log ""
+                log "${RED}❌ Agent exited with code ${AGENT_EXIT_CODE}: not authenticated${NC}"
+                record_iteration "$iteration" "$NEXT_TASK" "Not authenticated" "${MINUTES}m ${SECONDS}s" "$ITER_LOG" "$START_TIME" "$END_TIME"
+                show_agent_login_help
+                stop_run "The ${AGENT_TYPE} agent is not logged in" "Check log: ${ITER_LOG}"
+            elif [ "$AGENT_EXIT_CODE" -ne 0 ]; then
+                # e.g. the model is overloaded or unavailable
+                log ""
+                log "${RED}❌ Agent exited with code ${AGENT_EXIT_CODE} and no status marker after ${MINUTES}m ${SECONDS}s${NC}"
+                log "${RED}   Check log: ${ITER_LOG}${NC}"
+                record_iteration "$iteration" "$NEXT_TASK" "Agent failed" "${MINUTES}m ${SECONDS}s" "$ITER_LOG" "$START_TIME" "$END_TIME"
+                commit_wip "${NEXT_TASK%%:*}" "$iteration"
                 consecutive_failures=$((consecutive_failures + 1))
             else
                 log ""
                 log "${YELLOW}⚠️  No status marker found after ${MINUTES}m ${SECONDS}s${NC}"
+                record_iteration "$iteration" "$NEXT_TASK" "No status marker" "${MINUTES}m ${SECONDS}s" "$ITER_LOG" "$START_TIME" "$END_TIME"
                 consecutive_failures=0
 
-                # Still try to commit if there were changes
-                local TASK_ID=$(get_last_completed_task_id)
-                local TASK_DESC=$(get_last_completed_task_description)
-                if [ -n "$TASK_ID" ] && [ "$AUTO_COMMIT" = "true" ]; then
-                    commit_changes "$TASK_ID" "$TASK_DESC"
+                # Still commit if the agent checked the task off
+                if task_is_checked "$CURRENT_TASK_ID" && [ "$AUTO_COMMIT" = "true" ]; then
+                    commit_changes "$CURRENT_TASK_ID" "${NEXT_TASK#*: }"
                 fi
             fi
         else
@@ -1304,17 +4584,24 @@ main() {
             local SECONDS=$((DURATION % 60))
             log ""
             log "${RED}❌ Agent process failed after ${MINUTES}m ${SECONDS}s${NC}"
+            record_iteration "$iteration" "$NEXT_TASK" "Agent failed" "${MINUTES}m ${SECONDS}s" "$ITER_LOG" "$START_TIME" "$END_TIME"
+            commit_wip "${NEXT_TASK%%:*}" "$iteration"
             log "${RED}   Check log: ${ITER_LOG}${NC}"
             consecutive_failures=$((consecutive_failures + 1))
         fi
 
-        # Check for too many consecutive failures
+        # Check for too many consecutive failures, trying fallback models first
         if [ $consecutive_failures -ge $MAX_CONSECUTIVE_FAILURES ]; then
-            log "${RED}═══════════════════════════════════════════════════════════════${NC}"
-            log "${RED}STOPPING: ${MAX_CONSECUTIVE_FAILURES} consecutive failures detected${NC}"
-            log "${RED}Check logs for details: ${ITER_LOG}${NC}"
-            log "${RED}═══════════════════════════════════════════════════════════════${NC}"
-            exit 1
+            local failed_model="${SELECTED_MODEL:-default}"
+            if use_next_fallback_model; then
+                log ""
+                log "${YELLOW}⚠ ${MAX_CONSECUTIVE_FAILURES} consecutive failures with ${failed_model} - switching to fallback model ${SELECTED_MODEL}${NC}"
+                consecutive_failures=0
+            fi
+        fi
+        if [ $consecutive_failures -ge $MAX_CONSECUTIVE_FAILURES ]; then
+            STOP_REASON="${MAX_CONSECUTIVE_FAILURES} consecutive iterations failed (${NEXT_TASK%%:*})"
+            stop_run "${MAX_CONSECUTIVE_FAILURES} consecutive failures detected" "Check logs for details: ${ITER_LOG}"
         fi
 
         iteration=$((iteration + 1))
@@ -1330,7 +4617,7 @@ main() {
     log "${BLUE}═══════════════════════════════════════════════════════════════${NC}"
     log "${BLUE}   Run Complete${NC}"
     log "${BLUE}═══════════════════════════════════════════════════════════════${NC}"
-    local FINAL_REMAINING=$(count_remaining)
+    local FINAL_REMAINING=$(count_unfinished)
     local FINAL_COMPLETED=$(count_completed)
     local TASKS_DONE=$((FINAL_COMPLETED - INITIAL_COMPLETED))
     log "Tasks completed this run: ${TASKS_DONE}"
@@ -1338,9 +4625,31 @@ main() {
     log "Remaining: ${FINAL_REMAINING}"
     log "Iterations used: $((iteration - 1))"
     log "Master log: ${MASTER_LOG}"
+    local slowest=$(summarize_task_times | sort -t $'\t' -k3,3nr | head -3)
+    if [ -n "$slowest" ]; then
+        log "Slowest tasks:"
+        local task_id task_iterations task_seconds rest
+        while IFS=$'\t' read -r task_id task_iterations task_seconds rest; do
+            log "  ${task_id}  $(format_duration "$task_seconds") (${task_iterations} iteration(s))"
+        done <<< "$slowest"
+    fi
     log ""
 
-    if [ "$FINAL_REMAINING" -eq 0 ]; then
+    if [ ${#BLOCKED_TASK_IDS[@]} -gt 0 ]; then
+        log "${YELLOW}Blocked:${NC}"
+        local i
+        for i in "${!BLOCKED_TASK_IDS[@]}"; do
+            log "  ${BLOCKED_TASK_IDS[$i]}: ${BLOCKED_TASK_REASONS[$i]}"
+        done
+    fi
+    if [ ${#SKIPPED_TASK_IDS[@]} -gt 0 ] || [ ${#BLOCKED_TASK_IDS[@]} -gt 0 ]; then
+        if [ ${#SKIPPED_TASK_IDS[@]} -gt 0 ]; then
+            log "${YELLOW}Skipped this run: ${SKIPPED_TASK_IDS[*]}${NC}"
+        fi
+        log "${YELLOW}Run again to continue with remaining tasks.${NC}"
+    elif [ "$FINAL_REMAINING" -eq 0 ] && task_filter_active; then
+        log "${GREEN}🎉 All tasks matching the filter are complete!${NC}"
+    elif [ "$FINAL_REMAINING" -eq 0 ]; then
         log "${GREEN}🎉 All tasks are complete!${NC}"
     else
         log "${YELLOW}Run again to continue with remaining tasks.${NC}"
@@ -235,11 +235,13 @@ update_ralph_installation() {
 
         # Try to preserve existing settings if possible
         local existing_agent="cursor"
+        local existing_model=""
         if [ -f "$config_file" ]; then
             existing_agent=$(grep 'AGENT_TYPE=' "$config_file" 2>/dev/null | cut -d'"' -f2 || echo "cursor")
+            existing_model=$(grep '^DEFAULT_MODEL=' "$config_file" 2>/dev/null | cut -d'"' -f2 || true)
         fi
 
-        create_config_file "$ralph_dir" "$project_name" "${existing_agent:-cursor}" "50" "true"
+        create_config_file "$ralph_dir" "$project_name" "${existing_agent:-cursor}" "50" "true" "$existing_model"
         print_success "Recreated .ralph/config.sh"
     else
         print_success "config.sh is valid - preserved"
@@ -368,7 +370,22 @@ run_setup_wizard() {
     echo ""
 
     #--------------------------------------------------------------------------
-    # Step 2: Git Branch
+    # Step 2: AI Model
+    #--------------------------------------------------------------------------
+    print_step "Step $step_num: AI Model"
+    ((step_num++))
+    echo ""
+
+    local default_model=$(select_agent_model "$agent_type")
+    if [ -n "$default_model" ]; then
+        print_success "Model: $default_model"
+    else
+        print_success "Model: chosen at startup"
+    fi
+    echo ""
+
+    #--------------------------------------------------------------------------
+    # Step 3: Git Branch
     #--------------------------------------------------------------------------
     print_step "Step $step_num: Git Branch"
     ((step_num++))
@@ -395,22 +412,46 @@ run_setup_wizard() {
     echo ""
 
     #--------------------------------------------------------------------------
-    # Step 3: Task File
+    # Step 4: Task File
     #--------------------------------------------------------------------------
     print_step "Step $step_num: Task List"
     ((step_num++))
     echo ""
 
     local create_sample_tasks=false
+    local import_tasks_from=""
+    local task_id_prefix="TASK"
 
     echo "Ralph Loop needs a TASKS.md file with your task checklist."
     echo ""
 
+    local import_strategy="replace"
+    local found_tasks=""
+    local find_result=0
+    found_tasks=$(find_project_task_file "$project_path") || find_result=$?
+
     if [ -f "$ralph_dir/TASKS.md" ]; then
         echo "Found existing task file."
         if ! ask_yes_no "Keep existing tasks?" "y"; then
             create_sample_tasks=true
+        elif [ $find_result -eq 0 ] && ask_yes_no "Merge new tasks from $(basename "$found_tasks") into it?" "n"; then
+            import_tasks_from="$found_tasks"
+            import_strategy="merge"
+        fi
+    elif [ $find_result -eq 2 ]; then
+        echo "Found several task lists in the project."
+        local candidates=()
+        while IFS= read -r candidate; do
+            candidates+=("$(basename "$candidate")")
+        done <<< "$found_tasks"
+        local choice=$(ask_choice "Which one should Ralph Loop import?" "${candidates[@]}" "None - create a sample TASKS.md")
+        if [ "$choice" = "None - create a sample TASKS.md" ]; then
+            create_sample_tasks=true
+        else
+            import_tasks_from="$project_path/$choice"
         fi
+    elif [ -n "$found_tasks" ] && ask_yes_no "Import tasks from $(basename "$found_tasks")?" "y"; then
+        import_tasks_from="$found_tasks"
     else
         if ask_yes_no "Create a sample TASKS.md to get started?" "y"; then
             create_sample_tasks=true
@@ -418,6 +459,11 @@ run_setup_wizard() {
             print_warning "You'll need to create .ralph/TASKS.md before running."
         fi
     fi
+
+    if [ -n "$import_tasks_from" ]; then
+        echo "Tasks without an ID will be numbered like TASK-001."
+        task_id_prefix=$(ask "Prefix for new task IDs" "TASK")
+    fi
     echo ""
 
     #--------------------------------------------------------------------------
@@ -426,7 +472,7 @@ run_setup_wizard() {
     print_header "Creating Configuration Files"
 
     # Create config.sh
-    create_config_file "$ralph_dir" "$project_name" "$agent_type" "50" "true"
+    create_config_file "$ralph_dir" "$project_name" "$agent_type" "50" "true" "$default_model"
     print_success "Created .ralph/config.sh"
 
     # Create build.sh and test.sh scripts (placeholder templates)
@@ -446,7 +492,16 @@ run_setup_wizard() {
     print_success "Created .ralph/docs/README.md"
 
     # Create TASKS.md if requested
-    if [ "$create_sample_tasks" = true ]; then
+    if [ -n "$import_tasks_from" ]; then
+        if import_tasks_file "$ralph_dir" "$import_tasks_from" "$task_id_prefix" 3 "$import_strategy"; then
+            print_success "Imported .ralph/TASKS.md from $(basename "$import_tasks_from")"
+        elif [ "$import_strategy" = "replace" ] && [ ! -f "$ralph_dir/TASKS.md" ]; then
+            create_tasks_file "$ralph_dir"
+            print_success "Created .ralph/TASKS.md"
+        else
+            print_warning "Couldn't import tasks from $(basename "$import_tasks_from"); .ralph/TASKS.md was left unchanged"
+        fi
+    elif [ "$create_sample_tasks" = true ]; then
         create_tasks_file "$ralph_dir"
         print_success "Created .ralph/TASKS.md"
     fi
@@ -532,6 +587,7 @@ offer_ai_setup_assistant() {
             echo "  Visit: https://augmentcode.com"
         fi
         echo ""
+        configure_scripts_from_detection "$project_path"
         echo "Happy automating! 🤖"
         return
     fi
@@ -551,13 +607,50 @@ offer_ai_setup_assistant() {
     echo ""
 
     if ask_yes_no "Run AI setup assistant now?" "y"; then
-        run_ai_setup_assistant "$project_path" "$agent_type"
+        if ! run_ai_setup_assistant "$project_path" "$agent_type"; then
+            configure_scripts_from_detection "$project_path"
+        fi
     else
         echo ""
+        configure_scripts_from_detection "$project_path"
         echo "You can run the setup assistant later. Happy automating! 🤖"
     fi
 }
 
+# Without the AI setup assistant, fill in build.sh and test.sh from the
+# project's marker files (go.mod, package.json, Cargo.toml...) so the build
+# and test gates work anyway. Scripts that were already configured are kept.
+configure_scripts_from_detection() {
+    local project_path="$1"
+    local ralph_dir="$project_path/.ralph"
+    local project_type=$(detect_project_type "$project_path")
+
+    if [ -z "$project_type" ]; then
+        return 0
+    fi
+
+    local build_command=$(detect_build_command "$project_path")
+    local test_command=$(detect_test_command "$project_path")
+    local configured=false
+
+    if [ -n "$build_command" ] && grep -q "SCRIPT NOT CONFIGURED" "$ralph_dir/build.sh" 2>/dev/null; then
+        create_detected_script "$ralph_dir" "build" "$build_command"
+        print_success "Configured .ralph/build.sh: $build_command"
+        configured=true
+    fi
+
+    if [ -n "$test_command" ] && grep -q "SCRIPT NOT CONFIGURED" "$ralph_dir/test.sh" 2>/dev/null; then
+        create_detected_script "$ralph_dir" "test" "$test_command"
+        print_success "Configured .ralph/test.sh: $test_command"
+        configured=true
+    fi
+
+    if [ "$configured" = true ]; then
+        echo "  Detected a $project_type project. Check the commands before running Ralph Loop."
+        echo ""
+    fi
+}
+
 #==============================================================================
 # MAIN ENTRY POINT
 #==============================================================================
@@ -642,6 +735,11 @@ main() {
 
     if [ -d "$ralph_dir" ]; then
         print_warning "This project already has Ralph Loop installed."
+        if [ -f "$ralph_dir/config.sh" ]; then
+            local installed_agent=$(grep '^AGENT_TYPE=' "$ralph_dir/config.sh" 2>/dev/null | cut -d'"' -f2)
+            local installed_model=$(grep '^DEFAULT_MODEL=' "$ralph_dir/config.sh" 2>/dev/null | cut -d'"' -f2)
+            echo -e "  Agent: ${BOLD}${installed_agent:-cursor}${NC}  Model: ${BOLD}${installed_model:-chosen at startup}${NC}"
+        fi
         echo ""
         echo "Options:"
         echo "  1) Update Ralph Loop (preserves your configuration)"
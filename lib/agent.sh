@@ -72,6 +72,50 @@ detect_or_select_agent() {
     echo "$choice"
 }
 
+#==============================================================================
+# MODEL SELECTION
+#==============================================================================
+
+# List the model IDs an agent supports, one per line (empty if unknown)
+list_agent_models() {
+    local agent_type="$1"
+
+    case "$agent_type" in
+        cursor)
+            is_cursor_available || return 0
+            agent --list-models 2>/dev/null | grep -E "^[a-z]" | awk '{print $1}' | grep -v "^Tip:" | grep -v "^Available"
+            ;;
+        auggie)
+            is_auggie_available || return 0
+            auggie models list 2>/dev/null | grep -E "^[a-z]" | awk '{print $1}'
+            ;;
+    esac
+    return 0
+}
+
+# Let the user pick a default model for config.sh.
+# Prints the chosen model, or nothing to keep choosing at startup.
+select_agent_model() {
+    local agent_type="$1"
+    local models_list=$(list_agent_models "$agent_type")
+
+    if [ -z "$models_list" ]; then
+        echo "No model list available for $agent_type - the model will be chosen at startup." >&2
+        return 0
+    fi
+
+    local models=()
+    while IFS= read -r model; do
+        models+=("$model")
+    done <<< "$models_list"
+
+    local choice=$(ask_choice "Which model should Ralph Loop use by default?" "Ask every run" "${models[@]}")
+
+    if [ "$choice" != "Ask every run" ]; then
+        echo "$choice"
+    fi
+}
+
 #==============================================================================
 # AI SETUP ASSISTANT
 #==============================================================================
@@ -161,13 +205,19 @@ After completing the setup, tell the user:
 Output DONE when finished."
 
     # Run the agent
+    local agent_exit=0
     if [ "$agent_type" = "cursor" ]; then
-        agent "$setup_prompt"
+        agent "$setup_prompt" || agent_exit=$?
     elif [ "$agent_type" = "auggie" ]; then
-        auggie "$setup_prompt"
+        auggie "$setup_prompt" || agent_exit=$?
     fi
 
     echo ""
+    if [ "$agent_exit" -ne 0 ]; then
+        print_warning "The setup assistant exited with code $agent_exit."
+        return 1
+    fi
+
     echo -e "${GREEN}━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━${NC}"
     echo -e "${GREEN}Setup complete! 🎉${NC}"
     echo -e "${GREEN}━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━${NC}"
@@ -34,6 +34,7 @@ readonly RALPH_VERSION="2.1.0"
 #   $3 - agent_type: Type of agent (cursor, auggie, custom)
 #   $4 - max_iterations: Maximum iterations for the loop
 #   $5 - build_gate_enabled: Whether build gate is enabled
+#   $6 - default_model: Model to use (optional, empty = ask at startup)
 #==============================================================================
 create_config_file() {
     local ralph_dir="$1"
@@ -41,6 +42,7 @@ create_config_file() {
     local agent_type="$3"
     local max_iterations="$4"
     local build_gate_enabled="$5"
+    local default_model="$6"
 
     local config_file="$ralph_dir/config.sh"
 
@@ -63,6 +65,7 @@ PROJECT_NAME="$project_name"
 #==============================================================================
 
 AGENT_TYPE="$agent_type"
+DEFAULT_MODEL="$default_model"  # Empty = choose at startup
 
 #==============================================================================
 # LOOP SETTINGS
@@ -180,3 +183,41 @@ EOF
     chmod +x "$test_file"
 }
 
+
+#==============================================================================
+# CREATE SCRIPT FROM DETECTED COMMAND
+#==============================================================================
+# Writes .ralph/build.sh or .ralph/test.sh running a command guessed from the
+# project's marker files (see detect_build_command / detect_test_command).
+#
+# Parameters:
+#   $1 - ralph_dir: Path to .ralph directory
+#   $2 - kind: "build" or "test"
+#   $3 - command: The command to run from the project root
+#==============================================================================
+create_detected_script() {
+    local ralph_dir="$1"
+    local kind="$2"
+    local command="$3"
+    local script_file="$ralph_dir/$kind.sh"
+    local title="Build"
+    [ "$kind" = "test" ] && title="Test"
+
+    cat > "$script_file" << EOF
+#!/bin/bash
+#
+# Ralph Loop - $title Script
+#
+# Detected from the project's files during setup. Adjust it if needed.
+# Exit code 0 = success, non-zero = failure.
+#
+
+set -e
+
+# Navigate to project root (parent of .ralph directory)
+cd "\$(dirname "\$0")/.."
+
+$command
+EOF
+    chmod +x "$script_file"
+}
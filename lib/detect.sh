@@ -3,7 +3,8 @@
 # detect.sh - Project Detection Library
 #
 # This is a library file meant to be sourced by other scripts.
-# It provides functions for detecting Xcode-specific configurations.
+# It provides functions for detecting Xcode-specific configurations and
+# guessing build/test commands from marker files.
 #
 # Usage:
 #   source "$(dirname "${BASH_SOURCE[0]}")/detect.sh"
@@ -87,3 +88,151 @@ detect_xcode_project_dir() {
     echo "."
 }
 
+
+#==============================================================================
+# BUILD/TEST COMMAND HELPERS
+#==============================================================================
+# Guess a project's build and test commands from its marker files, without
+# asking an agent. Used to configure build.sh and test.sh when the AI setup
+# assistant isn't available. Each helper prints nothing when it can't tell.
+
+detect_project_type() {
+    local project_dir="$1"
+
+    if [ -f "$project_dir/go.mod" ]; then
+        echo "go"
+    elif [ -f "$project_dir/Cargo.toml" ]; then
+        echo "rust"
+    elif [ -f "$project_dir/package.json" ]; then
+        echo "node"
+    elif [ -f "$project_dir/Package.swift" ]; then
+        echo "swift"
+    elif [ -f "$project_dir/pyproject.toml" ] || [ -f "$project_dir/setup.py" ] || [ -f "$project_dir/requirements.txt" ]; then
+        echo "python"
+    elif [ -f "$project_dir/Makefile" ]; then
+        echo "make"
+    fi
+}
+
+# npm, or the package manager whose lockfile is present
+detect_node_package_manager() {
+    local project_dir="$1"
+
+    if [ -f "$project_dir/pnpm-lock.yaml" ]; then
+        echo "pnpm"
+    elif [ -f "$project_dir/yarn.lock" ]; then
+        echo "yarn"
+    else
+        echo "npm"
+    fi
+}
+
+# Command of a script in package.json's "scripts" object. Keys elsewhere in
+# the file (e.g. electron-builder's top-level "build" config) don't count.
+# Uses node or jq when available; the awk fallback reads the first
+# "scripts" object, minified or not.
+get_package_script() {
+    local package_json="$1/package.json"
+    local script="$2"
+
+    if [ ! -f "$package_json" ]; then
+        return 0
+    fi
+
+    if command -v node &> /dev/null; then
+        node -e '
+            const scripts = JSON.parse(require("fs").readFileSync(process.argv[1], "utf8")).scripts || {};
+            const command = scripts[process.argv[2]];
+            if (typeof command === "string") console.log(command);
+        ' "$package_json" "$script" 2>/dev/null
+    elif command -v jq &> /dev/null; then
+        jq -r --arg name "$script" '.scripts[$name] | strings' "$package_json" 2>/dev/null
+    else
+        awk -v name="$script" '
+            { json = json $0 " " }
+            END {
+                if (!match(json, /"scripts"[[:space:]]*:[[:space:]]*\{[^}]*\}/)) exit
+                scripts = substr(json, RSTART, RLENGTH)
+                if (!match(scripts, "[{,][[:space:]]*\"" name "\"[[:space:]]*:[[:space:]]*\"([^\"\\\\]|\\\\.)*\"")) exit
+                command = substr(scripts, RSTART, RLENGTH)
+                sub(/^[{,][[:space:]]*"[^"]*"[[:space:]]*:[[:space:]]*"/, "", command)
+                sub(/"$/, "", command)
+                # Unescape \" and \\ like a JSON parser would
+                for (i = 1; i <= length(command); i++) {
+                    c = substr(command, i, 1)
+                    if (c == "\\" && substr(command, i + 1, 1) ~ /["\\\/]/) c = substr(command, ++i, 1)
+                    unescaped = unescaped c
+                }
+                print unescaped
+            }
+        ' "$package_json"
+    fi
+}
+
+# True if package.json defines the named script (npm's "no test specified"
+# stub doesn't count as a test script)
+has_package_script() {
+    local command=$(get_package_script "$1" "$2")
+    [ -n "$command" ] && ! echo "$command" | grep -q "no test specified"
+}
+
+# True if the Makefile has the named target
+has_make_target() {
+    grep -qE "^$2:" "$1/Makefile" 2>/dev/null
+}
+
+detect_build_command() {
+    local project_dir="$1"
+
+    case "$(detect_project_type "$project_dir")" in
+        go)
+            echo "go build ./..."
+            ;;
+        rust)
+            echo "cargo build"
+            ;;
+        node)
+            if has_package_script "$project_dir" "build"; then
+                echo "$(detect_node_package_manager "$project_dir") run build"
+            fi
+            ;;
+        swift)
+            echo "swift build"
+            ;;
+        python)
+            echo "python -m compileall -q ."
+            ;;
+        make)
+            echo "make"
+            ;;
+    esac
+}
+
+detect_test_command() {
+    local project_dir="$1"
+
+    case "$(detect_project_type "$project_dir")" in
+        go)
+            echo "go test ./..."
+            ;;
+        rust)
+            echo "cargo test"
+            ;;
+        node)
+            if has_package_script "$project_dir" "test"; then
+                echo "$(detect_node_package_manager "$project_dir") test"
+            fi
+            ;;
+        swift)
+            echo "swift test"
+            ;;
+        python)
+            echo "pytest"
+            ;;
+        make)
+            if has_make_target "$project_dir" "test"; then
+                echo "make test"
+            fi
+            ;;
+    esac
+}
@@ -9,6 +9,7 @@
 # Usage:
 #   source "$(dirname "${BASH_SOURCE[0]}")/lib/tasks.sh"
 #   create_tasks_file "/path/to/.ralph" "ios"
+#   import_tasks_file "/path/to/.ralph" "/path/to/TODO.md"
 #
 
 # Guard against double-sourcing
@@ -93,3 +94,359 @@ EOF
     fi
 }
 
+
+#==============================================================================
+# FIND PROJECT TASK FILE
+#==============================================================================
+# Looks in the project root for an existing task list (TASKS.md, TODO.md,
+# TODO.txt, BACKLOG.md, TASKS.csv, any case) that can be imported instead
+# of the sample tasks.
+#
+# Parameters:
+#   $1 - project_path: Path to the project root
+#
+# Output:
+#   The file to import, or every candidate (one per line) if ambiguous
+#
+# Returns:
+#   0 - one file found (TASKS.md wins over the others)
+#   1 - no task file found
+#   2 - several candidates and no TASKS.md; the caller must pick one
+#
+find_project_task_file() {
+    local project_path="$1"
+    local candidates=()
+    local name file
+
+    for name in TASKS.md TODO.md TODO.txt BACKLOG.md TASKS.csv; do
+        file=$(find "$project_path" -maxdepth 1 -type f -iname "$name" 2>/dev/null | sort | head -1)
+        if [ -n "$file" ]; then
+            candidates+=("$file")
+        fi
+    done
+
+    if [ ${#candidates[@]} -eq 0 ]; then
+        return 1
+    fi
+
+    if [ ${#candidates[@]} -eq 1 ] || [ "$(basename "${candidates[0]}" | tr '[:lower:]' '[:upper:]')" = "TASKS.MD" ]; then
+        echo "${candidates[0]}"
+        return 0
+    fi
+
+    printf '%s\n' "${candidates[@]}"
+    return 2
+}
+
+#==============================================================================
+# IMPORT TASKS FILE
+#==============================================================================
+# Copies an existing task list to .ralph/TASKS.md. Checkbox items without a
+# task ID ("- [ ] Fix login") are numbered <PREFIX>-001, <PREFIX>-002, ...
+# after the highest existing ID with that prefix, so the loop can track them.
+# IDs already in the file are kept as they are. .csv files are converted
+# with import_tasks_csv.
+#
+# With the "merge" strategy an existing .ralph/TASKS.md is kept and only
+# tasks with new IDs are appended; "replace" overwrites it. Either way,
+# duplicate IDs and near-identical task names are reported afterwards.
+#
+# Parameters:
+#   $1 - ralph_dir: Path to .ralph directory
+#   $2 - source_file: Task list to import
+#   $3 - id_prefix: Prefix for generated IDs (optional, default TASK)
+#   $4 - id_width: Zero-padding width for generated IDs (optional, default 3)
+#   $5 - strategy: "replace" or "merge" (optional, default replace)
+#
+# Returns:
+#   0 on success, 1 if the file has no checkbox tasks
+#
+import_tasks_file() {
+    local ralph_dir="$1"
+    local source_file="$2"
+    local id_prefix="${3:-TASK}"
+    local id_width="${4:-3}"
+    local strategy="${5:-replace}"
+    local tasks_file="$ralph_dir/TASKS.md"
+
+    if ! [[ "$id_prefix" =~ ^[A-Za-z][A-Za-z0-9_]*$ ]] || ! [[ "$id_width" =~ ^[0-9]+$ ]]; then
+        print_error "Invalid task ID scheme: prefix '$id_prefix', width '$id_width'"
+        return 1
+    fi
+
+    case "$strategy" in
+        replace|merge) ;;
+        *)
+            print_error "Unknown import strategy '$strategy' (use replace or merge)"
+            return 1
+            ;;
+    esac
+
+    case "$source_file" in
+        *.csv|*.CSV)
+            import_tasks_csv "$ralph_dir" "$source_file" "$id_prefix" "$id_width" "$strategy"
+            return
+            ;;
+    esac
+
+    if ! grep -qE '^[-*] \[[ xX]\] ' "$source_file"; then
+        print_error "No '- [ ] ...' tasks found in $source_file"
+        return 1
+    fi
+
+    # When merging, import to a temporary file and number after the IDs in
+    # both files so generated IDs can't collide with existing tasks
+    local output_file="$tasks_file"
+    local id_sources=("$source_file")
+    if [ "$strategy" = "merge" ] && [ -f "$tasks_file" ]; then
+        output_file=$(mktemp)
+        id_sources+=("$tasks_file")
+    fi
+
+    local highest=$(highest_task_number "$id_prefix" "${id_sources[@]}")
+
+    awk -v next_id="$(( 10#${highest:-0} + 1 ))" -v prefix="$id_prefix" -v width="$id_width" '
+        /^[-*] \[[ xX]\] / {
+            box = substr($0, 1, 6)
+            sub(/^\*/, "-", box)
+            sub(/\[X\]/, "[x]", box)
+            rest = substr($0, 7)
+            if (rest !~ /^[A-Za-z][A-Za-z0-9_]*-[0-9]+:/) {
+                rest = sprintf("%s-%0" width "d: %s", prefix, next_id++, rest)
+            }
+            print box rest
+            next
+        }
+        { print }
+    ' "$source_file" > "$output_file"
+
+    if [ "$output_file" != "$tasks_file" ]; then
+        merge_task_lists "$tasks_file" "$output_file"
+        rm -f "$output_file"
+    fi
+    report_duplicate_tasks "$tasks_file"
+}
+
+#==============================================================================
+# IMPORT TASKS FROM CSV
+#==============================================================================
+# Converts a spreadsheet export to .ralph/TASKS.md. Columns are matched by
+# header name (any case, any order):
+#   name        - required; the task line
+#   id          - optional; generated as <PREFIX>-NNN (after the highest
+#                 existing one) when empty or missing
+#   description - optional; added as a "> Goal:" line
+#   tags        - optional; comma-separated, added as [tags: ...]
+#   depends_on  - optional; added as a "> Depends on:" line
+# Quoted fields may contain commas, doubled quotes and newlines.
+#
+# Parameters:
+#   $1 - ralph_dir: Path to .ralph directory
+#   $2 - csv_file: CSV file to import
+#   $3 - id_prefix: Prefix for generated IDs (optional, default TASK)
+#   $4 - id_width: Zero-padding width for generated IDs (optional, default 3)
+#   $5 - strategy: "replace" or "merge" (optional, see import_tasks_file)
+#
+# Returns:
+#   0 on success, 1 if the name column is missing or there are no rows
+#
+import_tasks_csv() {
+    local ralph_dir="$1"
+    local csv_file="$2"
+    local id_prefix="${3:-TASK}"
+    local id_width="${4:-3}"
+    local strategy="${5:-replace}"
+    local tasks_file="$ralph_dir/TASKS.md"
+    local output
+
+    local output_file="$tasks_file"
+    local id_sources=("$csv_file")
+    if [ "$strategy" = "merge" ] && [ -f "$tasks_file" ]; then
+        output_file=$(mktemp)
+        id_sources+=("$tasks_file")
+    fi
+
+    # Generated IDs start after the highest ID with the same prefix
+    local highest=$(highest_task_number "$id_prefix" "${id_sources[@]}")
+
+    if ! output=$(awk -v prefix="$id_prefix" -v width="$id_width" -v generated="$(( 10#${highest:-0} ))" '
+        # Split one CSV record into fields[], honoring quotes
+        function parse(record,    i, c, field, quoted, n) {
+            split("", fields)
+            n = 0; field = ""; quoted = 0
+            for (i = 1; i <= length(record); i++) {
+                c = substr(record, i, 1)
+                if (quoted) {
+                    if (c == "\"" && substr(record, i + 1, 1) == "\"") { field = field c; i++ }
+                    else if (c == "\"") quoted = 0
+                    else field = field c
+                } else if (c == "\"") quoted = 1
+                else if (c == ",") { fields[++n] = field; field = "" }
+                else field = field c
+            }
+            fields[++n] = field
+            return n
+        }
+        function trim(s) { gsub(/^[ \t]+|[ \t]+$/, "", s); return s }
+        {
+            sub(/\r$/, "")
+            record = (pending == "" ? $0 : pending "\n" $0)
+            # An odd number of quotes means a quoted field continues on the next line
+            if (gsub(/"/, "\"", record) % 2 == 1) { pending = record; next }
+            pending = ""
+            n = parse(record)
+
+            if (!have_header) {
+                for (i = 1; i <= n; i++) col[tolower(trim(fields[i]))] = i
+                if (!("name" in col)) { print "missing required column: name" > "/dev/stderr"; exit 2 }
+                have_header = 1
+                next
+            }
+
+            name = trim(fields[col["name"]])
+            if (name == "") next
+            id = ("id" in col) ? trim(fields[col["id"]]) : ""
+            if (id == "") id = sprintf("%s-%0" width "d", prefix, ++generated)
+            line = "- [ ] " id ": " name
+            if ("tags" in col && trim(fields[col["tags"]]) != "") line = line " [tags: " trim(fields[col["tags"]]) "]"
+            print line
+            if ("description" in col && trim(fields[col["description"]]) != "") {
+                desc = trim(fields[col["description"]])
+                gsub(/\n/, "\n  > ", desc)
+                print "  > Goal: " desc
+            }
+            if ("depends_on" in col && trim(fields[col["depends_on"]]) != "") print "  > Depends on: " trim(fields[col["depends_on"]])
+            print ""
+            rows++
+        }
+        END { if (!rows) exit 1 }
+    ' "$csv_file"); then
+        print_error "Could not import tasks from $csv_file (needs a 'name' column and at least one row)"
+        return 1
+    fi
+
+    {
+        echo "# Task List"
+        echo ""
+        echo "Imported from $(basename "$csv_file")"
+        echo ""
+        echo "---"
+        echo ""
+        echo "$output"
+    } > "$output_file"
+
+    if [ "$output_file" != "$tasks_file" ]; then
+        merge_task_lists "$tasks_file" "$output_file"
+        rm -f "$output_file"
+    fi
+    report_duplicate_tasks "$tasks_file"
+}
+
+#==============================================================================
+# DUPLICATE DETECTION
+#==============================================================================
+
+# Highest N among <PREFIX>-N IDs mentioned in the given files (empty if none)
+highest_task_number() {
+    local prefix="$1"
+    shift
+    cat "$@" 2>/dev/null | grep -oE "(^|[^A-Za-z0-9_])${prefix}-[0-9]+" | grep -oE '[0-9]+$' | sort -n | tail -1
+}
+
+# Print task IDs that appear on more than one task line
+find_duplicate_task_ids() {
+    local tasks_file="$1"
+    grep -oE '^- \[[ x]\] [A-Za-z][A-Za-z0-9_]*-[0-9]+:' "$tasks_file" 2>/dev/null \
+        | sed -E 's/^- \[[ x]\] //; s/:$//' | sort | uniq -d
+}
+
+# Print groups of tasks whose names only differ in case, spacing or
+# punctuation, one group per line: "TASK-001, TASK-007: Add login form"
+find_similar_task_names() {
+    local tasks_file="$1"
+    awk '
+        /^- \[[ x]\] [A-Za-z][A-Za-z0-9_]*-[0-9]+: / {
+            line = $0
+            sub(/^- \[[ x]\] /, "", line)
+            id = line; sub(/:.*/, "", id)
+            name = line; sub(/^[^:]*: /, "", name)
+            gsub(/ *\[(tags|template|priority|paths|fix-attempts):[^]]*\]/, "", name)
+            gsub(/ *\[skip-verify\]/, "", name)
+            key = tolower(name); gsub(/[^a-z0-9]/, "", key)
+            if (key == "") next
+            ids[key] = count[key]++ ? ids[key] ", " id : id
+            if (!(key in first)) { first[key] = name; order[++n] = key }
+        }
+        END {
+            for (i = 1; i <= n; i++) {
+                if (count[order[i]] > 1) print ids[order[i]] ": " first[order[i]]
+            }
+        }
+    ' "$tasks_file"
+}
+
+# Warn about duplicate IDs and near-identical names in a task file
+report_duplicate_tasks() {
+    local tasks_file="$1"
+    local id group
+
+    for id in $(find_duplicate_task_ids "$tasks_file"); do
+        print_warning "Duplicate task ID $id in $(basename "$tasks_file") - give each task a unique ID"
+    done
+
+    while IFS= read -r group; do
+        if [ -n "$group" ]; then
+            print_warning "Possible duplicate tasks: $group"
+        fi
+    done <<< "$(find_similar_task_names "$tasks_file")"
+    return 0
+}
+
+# Append the tasks from imported_file whose IDs are not in tasks_file yet.
+# Each task keeps its indented detail lines. Skipped IDs are reported.
+merge_task_lists() {
+    local tasks_file="$1"
+    local imported_file="$2"
+    local merged=$(mktemp)
+    local added_file=$(mktemp)
+
+    awk -v added_file="$added_file" '
+        function task_id(line,    id) {
+            id = line
+            sub(/^- \[[ x]\] /, "", id)
+            sub(/:.*/, "", id)
+            return id
+        }
+        FNR == NR {
+            print
+            if ($0 ~ /^- \[[ x]\] [A-Za-z][A-Za-z0-9_]*-[0-9]+:/) existing[task_id($0)] = 1
+            next
+        }
+        /^- \[[ x]\] / {
+            id = task_id($0)
+            keep = !(id in existing)
+            if (keep) {
+                if (!added++) print ""
+                print
+                existing[id] = 1
+                print id > added_file
+            } else {
+                print "skipped " id > "/dev/stderr"
+            }
+            next
+        }
+        /^[ \t]+[^ \t]/ { if (keep) print; next }
+        { keep = 0 }
+    ' "$tasks_file" "$imported_file" > "$merged" 2> "$merged.skipped"
+
+    mv "$merged" "$tasks_file"
+
+    local added=$(grep -c . "$added_file")
+    local skipped=$(sed 's/^skipped //' "$merged.skipped" | tr '\n' ' ')
+    rm -f "$added_file" "$merged.skipped"
+
+    print_success "Merged $added new task(s) into $(basename "$tasks_file")"
+    if [ -n "$skipped" ]; then
+        print_warning "Kept the existing version of: $skipped"
+    fi
+}
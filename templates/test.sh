@@ -36,6 +36,13 @@ cd "$(dirname "$0")/.."
 #
 # Go:
 #   go test ./...
+#
+# Testing only what changed (TEST_CHANGED_ONLY=true in config.sh):
+#   RALPH_CHANGED_FILES lists the files changed by the current task, one per
+#   line (some may have been deleted). It's empty when everything should run.
+#   Go example, falling back to the full suite when no Go files changed:
+#     pkgs=$(echo "$RALPH_CHANGED_FILES" | grep '\.go$' | xargs -n1 dirname | sort -u | sed 's|^|./|')
+#     if [ -n "$pkgs" ]; then go test $pkgs; else go test ./...; fi
 
 # PLACEHOLDER: Remove this block and add your test command above
 echo "━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━"
@@ -66,6 +66,28 @@ test_config_build_gate() {
     assert_contains "$content" "BUILD_GATE_ENABLED=false" "Should contain build gate setting"
 }
 
+# Test: config.sh contains the selected default model
+test_config_default_model() {
+    local ralph_dir="$TEST_TEMP_DIR/.ralph15"
+    mkdir -p "$ralph_dir"
+
+    create_config_file "$ralph_dir" "TestProject" "cursor" "50" "true" "sonnet-4.5"
+
+    local content=$(cat "$ralph_dir/config.sh")
+    assert_contains "$content" 'DEFAULT_MODEL="sonnet-4.5"' "Should contain default model"
+}
+
+# Test: config.sh leaves the model empty when none is selected
+test_config_default_model_empty() {
+    local ralph_dir="$TEST_TEMP_DIR/.ralph16"
+    mkdir -p "$ralph_dir"
+
+    create_config_file "$ralph_dir" "TestProject" "cursor" "50" "true"
+
+    local content=$(cat "$ralph_dir/config.sh")
+    assert_contains "$content" 'DEFAULT_MODEL=""' "Should leave default model empty"
+}
+
 # Test: config.sh has valid bash syntax
 test_config_valid_syntax() {
     local ralph_dir="$TEST_TEMP_DIR/.ralph6"
@@ -158,6 +180,17 @@ test_test_script_valid_syntax() {
     bash -n "$ralph_dir/test.sh"
 }
 
+# Test: create_detected_script writes the detected command
+test_create_detected_script() {
+    local ralph_dir="$TEST_TEMP_DIR/.ralph15"
+    mkdir -p "$ralph_dir"
+
+    create_detected_script "$ralph_dir" "test" "go test ./..."
+
+    assert_contains "$(cat "$ralph_dir/test.sh")" "go test ./..." "test.sh should run the detected command" && \
+    bash -n "$ralph_dir/test.sh" && [ -x "$ralph_dir/test.sh" ]
+}
+
 # Test: RALPH_VERSION is defined
 test_ralph_version_defined() {
     [ -n "$RALPH_VERSION" ]
@@ -169,6 +202,8 @@ run_test "config.sh contains project name" test_config_contains_project_name
 run_test "config.sh contains agent type" test_config_contains_agent_type
 run_test "config.sh contains max iterations" test_config_max_iterations
 run_test "config.sh contains build gate setting" test_config_build_gate
+run_test "config.sh contains default model" test_config_default_model
+run_test "config.sh default model empty when not selected" test_config_default_model_empty
 run_test "config.sh has valid bash syntax" test_config_valid_syntax
 run_test "create_build_script creates build.sh" test_create_build_script_exists
 run_test "build.sh is executable" test_build_script_executable
@@ -178,5 +213,6 @@ run_test "build.sh contains placeholder" test_build_script_contains_placeholder
 run_test "create_prompt_files creates both files" test_create_prompt_files
 run_test "build.sh has valid bash syntax" test_build_script_valid_syntax
 run_test "test.sh has valid bash syntax" test_test_script_valid_syntax
+run_test "create_detected_script writes the command" test_create_detected_script
 run_test "RALPH_VERSION is defined" test_ralph_version_defined
 
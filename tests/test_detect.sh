@@ -2,7 +2,7 @@
 #==============================================================================
 # Test: Detection Functions
 #==============================================================================
-# Tests for lib/detect.sh Xcode detection helpers.
+# Tests for lib/detect.sh Xcode and build/test command detection helpers.
 #==============================================================================
 
 # Source the library
@@ -63,8 +63,98 @@ test_detect_xcode_schemes_xcodebuild() {
     [ -z "$result" ] || [ -n "$result" ]  # Either empty or has content is fine
 }
 
+# Test: detect_build_command / detect_test_command for a Go module
+test_detect_go_commands() {
+    local test_dir="$TEST_TEMP_DIR/go_project"
+    mkdir -p "$test_dir"
+    echo "module example.com/app" > "$test_dir/go.mod"
+
+    assert_equals "go" "$(detect_project_type "$test_dir")" "Should detect a Go project"
+    assert_equals "go build ./..." "$(detect_build_command "$test_dir")" "Should build with go build"
+    assert_equals "go test ./..." "$(detect_test_command "$test_dir")" "Should test with go test"
+}
+
+# Test: package.json scripts and lockfile decide the Node commands
+test_detect_node_commands() {
+    local test_dir="$TEST_TEMP_DIR/node_project"
+    mkdir -p "$test_dir"
+    cat > "$test_dir/package.json" << 'EOF2'
+{
+  "scripts": {
+    "build": "tsc",
+    "test": "echo \"Error: no test specified\" && exit 1"
+  }
+}
+EOF2
+    touch "$test_dir/yarn.lock"
+
+    assert_equals "yarn run build" "$(detect_build_command "$test_dir")" "Should use the build script with yarn"
+    assert_equals "" "$(detect_test_command "$test_dir")" "Should ignore npm's placeholder test script"
+}
+
+# Test: only keys inside "scripts" count as package.json scripts
+test_detect_node_ignores_keys_outside_scripts() {
+    local test_dir="$TEST_TEMP_DIR/electron_project"
+    mkdir -p "$test_dir"
+    cat > "$test_dir/package.json" << 'EOF2'
+{
+  "name": "app",
+  "scripts": {
+    "test": "jest"
+  },
+  "build": {
+    "appId": "com.example.app"
+  }
+}
+EOF2
+
+    assert_equals "" "$(detect_build_command "$test_dir")" "electron-builder's build config is not a build script" && \
+    assert_equals "npm test" "$(detect_test_command "$test_dir")" "Should still find the test script"
+}
+
+# Test: scripts are found in a minified package.json
+test_detect_node_minified_package_json() {
+    local test_dir="$TEST_TEMP_DIR/minified_project"
+    mkdir -p "$test_dir"
+    echo '{"name":"app","build":{"appId":"x"},"scripts":{"lint":"eslint .","build":"vite build"}}' > "$test_dir/package.json"
+
+    assert_equals "npm run build" "$(detect_build_command "$test_dir")" "Should find the build script on one line"
+}
+
+# Test: the awk fallback reads "scripts" without node or jq
+test_get_package_script_without_node() {
+    local test_dir="$TEST_TEMP_DIR/fallback_project"
+    local bin_dir="$TEST_TEMP_DIR/bin"
+    mkdir -p "$test_dir" "$bin_dir"
+    ln -s "$(command -v awk)" "$bin_dir/awk"
+    echo '{"build":{"appId":"x"},"scripts":{"test":"echo \"ok\" && jest \\\\d","build:web":"vite build"}}' > "$test_dir/package.json"
+
+    local build test web
+    build=$(PATH="$bin_dir" get_package_script "$test_dir" "build")
+    test=$(PATH="$bin_dir" get_package_script "$test_dir" "test")
+    web=$(PATH="$bin_dir" get_package_script "$test_dir" "build:web")
+
+    assert_equals "" "$build" "Keys outside scripts should be ignored" && \
+    assert_equals 'echo "ok" && jest \\d' "$test" "Should unescape quotes and backslashes" && \
+    assert_equals "vite build" "$web" "Should read a script whose name has a colon"
+}
+
+# Test: nothing is detected without marker files
+test_detect_unknown_project() {
+    local test_dir="$TEST_TEMP_DIR/unknown_project"
+    mkdir -p "$test_dir"
+
+    assert_equals "" "$(detect_project_type "$test_dir")" "Should not guess a project type"
+    assert_equals "" "$(detect_build_command "$test_dir")" "Should not guess a build command"
+}
+
 # Run all tests
 run_test "detect_xcode_project_dir returns '.' for root" test_detect_xcode_project_dir_root
 run_test "detect_xcode_schemes parses XcodeGen project.yml" test_detect_xcode_schemes_xcodegen
 run_test "detect_xcode_schemes with xcodebuild (macOS only)" test_detect_xcode_schemes_xcodebuild
-
+run_test "detect commands for a Go module" test_detect_go_commands
+run_test "detect commands from package.json scripts" test_detect_node_commands
+run_test "detect ignores package.json keys outside scripts" test_detect_node_ignores_keys_outside_scripts
+run_test "detect scripts in a minified package.json" test_detect_node_minified_package_json
+run_test "get_package_script falls back to awk" test_get_package_script_without_node
+run_test "detect nothing without marker files" test_detect_unknown_project
@@ -0,0 +1,186 @@
+#!/bin/bash
+#==============================================================================
+# Test: Loop Engine
+#==============================================================================
+# Tests for functions in core/ralph_loop.sh. The script runs on its own
+# from .ralph/ and starts a run when sourced, so each test loads only the
+# functions it needs.
+#==============================================================================
+
+# Define functions from core/ralph_loop.sh in the current shell
+load_loop_functions() {
+    local name
+    for name in "$@"; do
+        eval "$(sed -n "/^${name}() {/,/^}/p" "$REPO_ROOT/core/ralph_loop.sh")"
+    done
+}
+
+# Print the value at a jq-style path (e.g. .message) of each JSON line on
+# stdin; fails if any line isn't valid JSON
+read_json_field() {
+    local field="$1"
+    if command -v jq &> /dev/null; then
+        jq -er "$field"
+    else
+        python3 -c '
+import json, sys
+for line in sys.stdin:
+    print(json.loads(line)[sys.argv[1].lstrip(".")])
+' "$field"
+    fi
+}
+
+load_loop_functions redact format_json_log json_escape
+
+# Test: format_json_log emits one valid JSON object per line
+test_format_json_log_is_valid_json() {
+    local RUN_ID="20260101_120000"
+    local CURRENT_TASK_ID="TASK-001"
+    local REDACT_SED=""
+    local output=$(printf '%s\n' 'Plain line' 'Quotes "here" and \back\slash' $'tab\there' | format_json_log info)
+
+    local messages
+    messages=$(echo "$output" | read_json_field .message) || return 1
+    assert_equals $'Plain line\nQuotes "here" and \\back\\slash\ntab\there' "$messages" "Messages should survive a JSON round trip" && \
+    assert_equals "TASK-001" "$(echo "$output" | head -1 | read_json_field .task_id)" "Lines should carry the task ID"
+}
+
+# Test: format_json_log drops colors and control characters
+test_format_json_log_strips_colors() {
+    local RUN_ID="20260101_120000"
+    local CURRENT_TASK_ID=""
+    local output=$(printf '\033[0;31m❌ Build failed\033[0m\001\n' | format_json_log error)
+
+    local message
+    message=$(echo "$output" | read_json_field .message) || return 1
+    assert_equals "❌ Build failed" "$message" "Colors and control characters should be removed" && \
+    assert_equals "error" "$(echo "$output" | read_json_field .level)" "The level should be kept"
+}
+
+# Test: format_json_log skips empty lines
+test_format_json_log_skips_empty_lines() {
+    local RUN_ID="20260101_120000"
+    local output=$(printf 'one\n\n\033[0m\ntwo\n' | format_json_log info)
+
+    assert_equals "2" "$(echo "$output" | wc -l | tr -d ' ')" "Only lines with content should be logged"
+}
+
+# Test: json_escape output is a valid JSON string with newlines kept
+test_json_escape_is_valid_json() {
+    local REDACT_SED=""
+    local escaped=$(printf '%s\n' 'first "line"' $'second\tline\\' | json_escape)
+
+    local value
+    value=$(printf '{"value":"%s"}\n' "$escaped" | read_json_field .value) || return 1
+    assert_equals $'first "line"\nsecond\tline\\' "$value" "Escaped text should parse back to the original"
+}
+
+load_loop_functions kill_process_tree watch_process deadline_passed file_idle_for get_file_mtime \
+    start_stuck_watchdog start_agent_timeout get_agent_timeout_setting get_agent_timeout_minutes \
+    wait_for_agent wait_with_timeout
+
+# Fake clock for the minute-based limits: each reading is a minute after the
+# previous one, so a 1 minute limit passes at the first check. Readings
+# happen in subshells, so the count is kept in a file.
+use_fast_clock() {
+    echo 0 > "$TEST_TEMP_DIR/clock"
+    date() {
+        local minutes=$(cat "$TEST_TEMP_DIR/clock")
+        echo $((minutes + 1)) > "$TEST_TEMP_DIR/clock"
+        echo $(($(command date +%s) + minutes * 60))
+    }
+}
+
+# Test: wait_for_agent kills an agent that runs past its timeout
+test_wait_for_agent_times_out() {
+    local log_file="$TEST_TEMP_DIR/agent.log"
+    local AGENT_TYPE="custom"
+    local AGENT_TIMEOUT_MINUTES=1
+    local STUCK_TIMEOUT_MINUTES=0
+    local WATCH_INTERVAL_SECONDS=1
+    use_fast_clock
+
+    local started=$(command date +%s)
+    sleep 30 > "$log_file" &
+    local exit_code=0
+    wait_for_agent $! "$log_file" || exit_code=$?
+
+    [ $(($(command date +%s) - started)) -lt 10 ] || { echo "    Agent wasn't stopped at its timeout"; return 1; }
+    [ "$exit_code" -ne 0 ] || { echo "    A killed agent should fail"; return 1; }
+    assert_contains "$(cat "$log_file")" "ERROR: Agent timed out after 1m" "The log should get an ERROR marker"
+}
+
+# Test: wait_for_agent kills an agent whose log stops changing
+test_wait_for_agent_stuck() {
+    local log_file="$TEST_TEMP_DIR/agent.log"
+    local AGENT_TYPE="custom"
+    local AGENT_TIMEOUT_MINUTES=0
+    local STUCK_TIMEOUT_MINUTES=1
+    local WATCH_INTERVAL_SECONDS=1
+    use_fast_clock
+
+    local started=$(command date +%s)
+    sleep 30 > "$log_file" &
+    wait_for_agent $! "$log_file"
+
+    [ $(($(command date +%s) - started)) -lt 10 ] || { echo "    Stuck agent wasn't stopped"; return 1; }
+    assert_contains "$(cat "$log_file")" "ERROR: Agent stuck - no output for 1m" "The log should get an ERROR marker"
+}
+
+# Test: wait_for_agent returns the exit code of an agent that finishes in time
+test_wait_for_agent_finishes() {
+    local log_file="$TEST_TEMP_DIR/agent.log"
+    local AGENT_TYPE="custom"
+    local AGENT_TIMEOUT_MINUTES=5
+    local STUCK_TIMEOUT_MINUTES=0
+    local WATCH_INTERVAL_SECONDS=1
+
+    (echo "done"; exit 3) > "$log_file" &
+    local exit_code=0
+    wait_for_agent $! "$log_file" || exit_code=$?
+
+    assert_equals "3" "$exit_code" "The agent's exit code should be returned" && \
+    assert_equals "done" "$(cat "$log_file")" "Nothing should be added to the log"
+}
+
+# Test: wait_with_timeout stops a process after timeout_secs
+test_wait_with_timeout() {
+    local started=$(date +%s)
+    sleep 30 &
+    local exit_code=0
+    wait_with_timeout $! 1 || exit_code=$?
+
+    assert_equals "124" "$exit_code" "A timed out process should return 124" && \
+    [ $(($(date +%s) - started)) -lt 10 ]
+}
+
+load_loop_functions get_extends_root
+
+# Test: get_extends_root allows the repository's parent directory
+test_extends_root_is_parent() {
+    local project_dir="$TEST_TEMP_DIR/projects/app"
+    mkdir -p "$project_dir"
+    git -C "$project_dir" init -q
+
+    assert_equals "$(cd "$TEST_TEMP_DIR/projects" && pwd -P)" "$(get_extends_root "$project_dir")" "Should be the repository's parent"
+}
+
+# Test: get_extends_root doesn't allow all of / for a repository at the root
+test_extends_root_for_root_level_repo() {
+    # A top-level directory that exists everywhere, like /tmp or /private
+    local root_level_dir="/$(cd "$TEST_TEMP_DIR" && pwd -P | cut -d/ -f2)"
+
+    assert_equals "$root_level_dir" "$(GIT_CEILING_DIRECTORIES=/ get_extends_root "$root_level_dir")" "Should be the repository itself"
+}
+
+# Run all tests
+run_test "format_json_log emits valid JSON lines" test_format_json_log_is_valid_json
+run_test "format_json_log strips colors and control characters" test_format_json_log_strips_colors
+run_test "format_json_log skips empty lines" test_format_json_log_skips_empty_lines
+run_test "json_escape produces a valid JSON string" test_json_escape_is_valid_json
+run_test "wait_for_agent stops an agent at its timeout" test_wait_for_agent_times_out
+run_test "wait_for_agent stops a stuck agent" test_wait_for_agent_stuck
+run_test "wait_for_agent returns the exit code of an agent that finishes" test_wait_for_agent_finishes
+run_test "wait_with_timeout stops a process at its timeout" test_wait_with_timeout
+run_test "get_extends_root is the repository's parent" test_extends_root_is_parent
+run_test "get_extends_root is the repository itself at the filesystem root" test_extends_root_for_root_level_repo
@@ -186,6 +186,7 @@ main() {
     run_test_suite "Git Functions Tests" "$TESTS_DIR/test_git.sh"
     run_test_suite "Config Generation Tests" "$TESTS_DIR/test_config.sh"
     run_test_suite "Tasks Generation Tests" "$TESTS_DIR/test_tasks.sh"
+    run_test_suite "Loop Engine Tests" "$TESTS_DIR/test_loop.sh"
 
     # Summary
     echo ""
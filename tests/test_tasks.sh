@@ -107,6 +107,148 @@ test_tasks_goal_format() {
     assert_contains "$content" "> Goal:" "Should contain goal format"
 }
 
+# Test: find_project_task_file prefers TASKS.md
+test_find_task_file_prefers_tasks_md() {
+    local project="$TEST_TEMP_DIR/find1"
+    mkdir -p "$project"
+    echo "- [ ] a" > "$project/TODO.md"
+    echo "- [ ] b" > "$project/TASKS.md"
+
+    local found=$(find_project_task_file "$project")
+    assert_equals "$project/TASKS.md" "$found" "Should prefer TASKS.md"
+}
+
+# Test: find_project_task_file returns 2 when ambiguous
+test_find_task_file_ambiguous() {
+    local project="$TEST_TEMP_DIR/find2"
+    mkdir -p "$project"
+    echo "- [ ] a" > "$project/TODO.md"
+    echo "- [ ] b" > "$project/BACKLOG.md"
+
+    local result=0
+    find_project_task_file "$project" > /dev/null || result=$?
+    assert_equals "2" "$result" "Should report several candidates"
+}
+
+# Test: find_project_task_file returns 1 when nothing is found
+test_find_task_file_none() {
+    local project="$TEST_TEMP_DIR/find3"
+    mkdir -p "$project"
+
+    ! find_project_task_file "$project" > /dev/null
+}
+
+# Test: import_tasks_file numbers tasks without IDs
+test_import_tasks_assigns_ids() {
+    local ralph_dir="$TEST_TEMP_DIR/.ralph9"
+    mkdir -p "$ralph_dir"
+    printf -- '- [x] TASK-004: Done already\n- [ ] Fix login\n* [X] Write docs\n- [ ] API-7: Keep my ID\n' > "$TEST_TEMP_DIR/TODO.md"
+
+    import_tasks_file "$ralph_dir" "$TEST_TEMP_DIR/TODO.md"
+
+    local content=$(cat "$ralph_dir/TASKS.md")
+    assert_contains "$content" "- [x] TASK-004: Done already" "Should keep existing IDs" && \
+    assert_contains "$content" "- [ ] TASK-005: Fix login" "Should number after the highest ID" && \
+    assert_contains "$content" "- [x] TASK-006: Write docs" "Should normalize * [X] items" && \
+    assert_contains "$content" "- [ ] API-7: Keep my ID" "Should keep ticket-style IDs"
+}
+
+# Test: import_tasks_file uses a custom ID prefix and width
+test_import_tasks_custom_id_scheme() {
+    local ralph_dir="$TEST_TEMP_DIR/.ralph11"
+    mkdir -p "$ralph_dir"
+    printf -- '- [ ] PROJ-0041: Existing\n- [ ] New thing\n' > "$TEST_TEMP_DIR/TODO2.md"
+
+    import_tasks_file "$ralph_dir" "$TEST_TEMP_DIR/TODO2.md" "PROJ" 4
+
+    local content=$(cat "$ralph_dir/TASKS.md")
+    assert_contains "$content" "- [ ] PROJ-0042: New thing" "Should use the prefix and width"
+}
+
+# Test: import_tasks_file converts a CSV export
+test_import_tasks_csv() {
+    local ralph_dir="$TEST_TEMP_DIR/.ralph12"
+    mkdir -p "$ralph_dir"
+    cat > "$TEST_TEMP_DIR/tasks.csv" << 'EOF'
+Name,ID,Description,Tags,Depends_On
+Add login endpoint,TASK-002,"Accept email, password",backend,
+"Show ""Forgot password"" link",,"Below the form
+on the login page","frontend, auth",TASK-002
+EOF
+
+    import_tasks_file "$ralph_dir" "$TEST_TEMP_DIR/tasks.csv"
+
+    local content=$(cat "$ralph_dir/TASKS.md")
+    assert_contains "$content" "- [ ] TASK-002: Add login endpoint [tags: backend]" "Should keep IDs and add tags" && \
+    assert_contains "$content" "  > Goal: Accept email, password" "Should handle quoted commas" && \
+    assert_contains "$content" '- [ ] TASK-003: Show "Forgot password" link [tags: frontend, auth]' "Should generate the next free ID" && \
+    assert_contains "$content" "  > on the login page" "Should handle multi-line fields" && \
+    assert_contains "$content" "  > Depends on: TASK-002" "Should include dependencies"
+}
+
+# Test: a short CSV row doesn't reuse the previous row's fields
+test_import_tasks_csv_short_row() {
+    local ralph_dir="$TEST_TEMP_DIR/.ralph17"
+    mkdir -p "$ralph_dir"
+    printf 'name,id,description\nFirst,BUG-7,Explain first\nSecond\n' > "$TEST_TEMP_DIR/short.csv"
+
+    import_tasks_file "$ralph_dir" "$TEST_TEMP_DIR/short.csv" > /dev/null
+
+    local content=$(cat "$ralph_dir/TASKS.md")
+    assert_contains "$content" "- [ ] TASK-001: Second" "Should generate an ID for the short row" && \
+    [ "$(grep -c 'Goal: Explain first' "$ralph_dir/TASKS.md")" -eq 1 ]
+}
+
+# Test: CSV import fails without a name column
+test_import_tasks_csv_requires_name() {
+    local ralph_dir="$TEST_TEMP_DIR/.ralph13"
+    mkdir -p "$ralph_dir"
+    printf 'id,description\nTASK-001,Something\n' > "$TEST_TEMP_DIR/bad.csv"
+
+    ! import_tasks_file "$ralph_dir" "$TEST_TEMP_DIR/bad.csv" 2>/dev/null
+}
+
+# Test: merge keeps existing tasks and appends only new IDs
+test_import_tasks_merge() {
+    local ralph_dir="$TEST_TEMP_DIR/.ralph14"
+    mkdir -p "$ralph_dir"
+    printf -- '# Tasks\n- [x] TASK-001: Existing task\n  > Goal: keep me\n' > "$ralph_dir/TASKS.md"
+    printf -- '- [ ] TASK-001: Changed upstream\n- [ ] Brand new task\n  > Goal: added\n' > "$TEST_TEMP_DIR/TODO3.md"
+
+    import_tasks_file "$ralph_dir" "$TEST_TEMP_DIR/TODO3.md" "TASK" 3 merge > /dev/null
+
+    local content=$(cat "$ralph_dir/TASKS.md")
+    assert_contains "$content" "- [x] TASK-001: Existing task" "Should keep the existing task" && \
+    assert_contains "$content" "- [ ] TASK-002: Brand new task" "Should number new tasks after existing IDs" && \
+    assert_contains "$content" "  > Goal: added" "Should keep detail lines" && \
+    [ "$(grep -c 'TASK-001' "$ralph_dir/TASKS.md")" -eq 1 ]
+}
+
+# Test: find_duplicate_task_ids reports repeated IDs
+test_find_duplicate_task_ids() {
+    printf -- '- [ ] TASK-001: A\n- [ ] TASK-002: B\n- [x] TASK-001: C\n' > "$TEST_TEMP_DIR/dupes.md"
+
+    local dupes=$(find_duplicate_task_ids "$TEST_TEMP_DIR/dupes.md")
+    assert_equals "TASK-001" "$dupes" "Should report TASK-001"
+}
+
+# Test: find_similar_task_names groups near-identical names
+test_find_similar_task_names() {
+    printf -- '- [ ] TASK-001: Add login form\n- [ ] TASK-002: Other\n- [ ] TASK-003: add Login-form. [tags: ui]\n' > "$TEST_TEMP_DIR/similar.md"
+
+    local similar=$(find_similar_task_names "$TEST_TEMP_DIR/similar.md")
+    assert_equals "TASK-001, TASK-003: Add login form" "$similar" "Should group similar names"
+}
+
+# Test: import_tasks_file rejects files without checkbox tasks
+test_import_tasks_requires_checkboxes() {
+    local ralph_dir="$TEST_TEMP_DIR/.ralph10"
+    mkdir -p "$ralph_dir"
+    echo "Just some notes" > "$TEST_TEMP_DIR/NOTES.md"
+
+    ! import_tasks_file "$ralph_dir" "$TEST_TEMP_DIR/NOTES.md" 2>/dev/null
+}
+
 # Run all tests
 run_test "create_tasks_file creates TASKS.md" test_create_tasks_file_exists
 run_test "TASKS.md contains task format header" test_tasks_contains_format
@@ -116,4 +258,15 @@ run_test "TASKS.md contains task writing tips" test_tasks_contains_tips
 run_test "TASKS.md uses checkbox format" test_tasks_checkbox_format
 run_test "create_tasks_file handles templates" test_tasks_uses_template
 run_test "TASKS.md contains goal format" test_tasks_goal_format
-
+run_test "find_project_task_file prefers TASKS.md" test_find_task_file_prefers_tasks_md
+run_test "find_project_task_file reports ambiguity" test_find_task_file_ambiguous
+run_test "find_project_task_file returns 1 when none" test_find_task_file_none
+run_test "import_tasks_file assigns missing IDs" test_import_tasks_assigns_ids
+run_test "import_tasks_file requires checkbox tasks" test_import_tasks_requires_checkboxes
+run_test "import_tasks_file uses a custom ID scheme" test_import_tasks_custom_id_scheme
+run_test "import_tasks_file converts CSV" test_import_tasks_csv
+run_test "CSV import handles short rows" test_import_tasks_csv_short_row
+run_test "CSV import requires a name column" test_import_tasks_csv_requires_name
+run_test "import_tasks_file merge keeps existing tasks" test_import_tasks_merge
+run_test "find_duplicate_task_ids reports repeated IDs" test_find_duplicate_task_ids
+run_test "find_similar_task_names groups similar names" test_find_similar_task_names